@@ -0,0 +1,25 @@
+package blob
+
+import "errors"
+
+// Store represents a store for the files (blobs) shared in rooms.
+type Store interface {
+	Put(roomID string, f File, b []byte) error
+	Get(roomID, id string) (File, []byte, error)
+	RoomSize(roomID string) (int64, error)
+	Size() (int64, error)
+	Remove(roomID, id string) error
+	Rooms() ([]string, error)
+	RemoveRoom(roomID string) error
+}
+
+// File represents the properties of a file in the store.
+type File struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+}
+
+// ErrFileNotFound indicates that the requested file was not found.
+var ErrFileNotFound = errors.New("file not found")
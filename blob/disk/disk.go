@@ -0,0 +1,176 @@
+package disk
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/knadh/niltalk/blob"
+)
+
+// Config represents the disk blob store config structure.
+type Config struct {
+	Path string `koanf:"path"`
+}
+
+// Disk represents the local disk implementation of the blob Store interface.
+// Every room's files are kept in a directory named after the room along with
+// a JSON file with the properties of each file.
+type Disk struct {
+	cfg *Config
+}
+
+// New returns a new disk blob store.
+func New(cfg Config) (*Disk, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("path is empty")
+	}
+	if err := os.MkdirAll(cfg.Path, 0700); err != nil {
+		return nil, err
+	}
+	return &Disk{cfg: &cfg}, nil
+}
+
+// Put adds a file to a room.
+func (d *Disk) Put(roomID string, f blob.File, b []byte) error {
+	if !validName(roomID) || !validName(f.ID) {
+		return errors.New("invalid file ID")
+	}
+
+	dir := filepath.Join(d.cfg.Path, roomID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, f.ID), b, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, f.ID+".json"), meta, 0600)
+}
+
+// Get gets a file in a room.
+func (d *Disk) Get(roomID, id string) (blob.File, []byte, error) {
+	if !validName(roomID) || !validName(id) {
+		return blob.File{}, nil, blob.ErrFileNotFound
+	}
+
+	var (
+		f   blob.File
+		dir = filepath.Join(d.cfg.Path, roomID)
+	)
+	meta, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil, blob.ErrFileNotFound
+		}
+		return f, nil, err
+	}
+	if err := json.Unmarshal(meta, &f); err != nil {
+		return f, nil, err
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil, blob.ErrFileNotFound
+		}
+		return f, nil, err
+	}
+	return f, b, nil
+}
+
+// RoomSize returns the total size of the files in a room.
+func (d *Disk) RoomSize(roomID string) (int64, error) {
+	if !validName(roomID) {
+		return 0, nil
+	}
+
+	files, err := os.ReadDir(filepath.Join(d.cfg.Path, roomID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var n int64
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		n += info.Size()
+	}
+	return n, nil
+}
+
+// Size returns the total size of the files in all rooms.
+func (d *Disk) Size() (int64, error) {
+	rooms, err := d.Rooms()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, id := range rooms {
+		s, err := d.RoomSize(id)
+		if err != nil {
+			return 0, err
+		}
+		n += s
+	}
+	return n, nil
+}
+
+// Remove deletes a file in a room.
+func (d *Disk) Remove(roomID, id string) error {
+	if !validName(roomID) || !validName(id) {
+		return nil
+	}
+
+	dir := filepath.Join(d.cfg.Path, roomID)
+	for _, name := range []string{id, id + ".json"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rooms returns the IDs of the rooms that have files.
+func (d *Disk) Rooms() ([]string, error) {
+	dirs, err := os.ReadDir(d.cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		if d.IsDir() {
+			out = append(out, d.Name())
+		}
+	}
+	return out, nil
+}
+
+// RemoveRoom deletes all the files in a room.
+func (d *Disk) RemoveRoom(roomID string) error {
+	if !validName(roomID) {
+		return nil
+	}
+	return os.RemoveAll(filepath.Join(d.cfg.Path, roomID))
+}
+
+// validName checks that a room or file ID can't escape the store's directory.
+func validName(s string) bool {
+	return s != "" && !strings.ContainsAny(s, `/\.`)
+}
@@ -0,0 +1,116 @@
+package mem
+
+import (
+	"sync"
+
+	"github.com/knadh/niltalk/blob"
+)
+
+// Config represents the InMemory blob store config structure.
+type Config struct{}
+
+// InMemory represents the in-memory implementation of the blob Store interface.
+type InMemory struct {
+	cfg   *Config
+	rooms map[string]map[string]file
+	mu    sync.RWMutex
+}
+
+type file struct {
+	blob.File
+	data []byte
+}
+
+// New returns a new in-memory blob store.
+func New(cfg Config) (*InMemory, error) {
+	return &InMemory{
+		cfg:   &cfg,
+		rooms: map[string]map[string]file{},
+	}, nil
+}
+
+// Put adds a file to a room.
+func (m *InMemory) Put(roomID string, f blob.File, b []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rooms[roomID]
+	if !ok {
+		r = map[string]file{}
+		m.rooms[roomID] = r
+	}
+	r[f.ID] = file{File: f, data: b}
+	return nil
+}
+
+// Get gets a file in a room.
+func (m *InMemory) Get(roomID, id string) (blob.File, []byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, ok := m.rooms[roomID][id]
+	if !ok {
+		return blob.File{}, nil, blob.ErrFileNotFound
+	}
+	return f.File, f.data, nil
+}
+
+// RoomSize returns the total size of the files in a room.
+func (m *InMemory) RoomSize(roomID string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var n int64
+	for _, f := range m.rooms[roomID] {
+		n += f.Size
+	}
+	return n, nil
+}
+
+// Size returns the total size of the files in all rooms.
+func (m *InMemory) Size() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var n int64
+	for _, r := range m.rooms {
+		for _, f := range r {
+			n += f.Size
+		}
+	}
+	return n, nil
+}
+
+// Remove deletes a file in a room.
+func (m *InMemory) Remove(roomID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r, ok := m.rooms[roomID]; ok {
+		delete(r, id)
+		if len(r) == 0 {
+			delete(m.rooms, roomID)
+		}
+	}
+	return nil
+}
+
+// Rooms returns the IDs of the rooms that have files.
+func (m *InMemory) Rooms() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make([]string, 0, len(m.rooms))
+	for id := range m.rooms {
+		out = append(out, id)
+	}
+	return out, nil
+}
+
+// RemoveRoom deletes all the files in a room.
+func (m *InMemory) RemoveRoom(roomID string) error {
+	m.mu.Lock()
+	delete(m.rooms, roomID)
+	m.mu.Unlock()
+	return nil
+}
@@ -2,25 +2,45 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/blob"
 	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/store"
 	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	hasAuth = 1 << iota
 	hasRoom
+	hasAdmin
+
+	// isPage marks handlers that respond with HTML pages rather than JSON.
+	isPage
 )
 
 type sess struct {
 	ID     string
+	PeerID string
 	Handle string
+	Role   string
+	Muted  bool
+
+	CreatedAt time.Time
 }
 
 // reqCtx is the context injected into every request.
@@ -47,12 +67,92 @@ type tplData struct {
 	Description string
 	Room        any
 	Auth        bool
+
+	// Token of the invite that the room page is opened with, if any.
+	Invite string
+
+	// Public rooms in the room directory and the tag they're filtered by.
+	Rooms []hub.PublicRoom
+	Tag   string
 }
 
 type reqRoom struct {
 	Name     string `json:"name"`
 	Handle   string `json:"handle"`
 	Password string `json:"password"`
+	E2E      bool   `json:"e2e"`
+
+	// Default expiry of the messages in the room (seconds).
+	MessageTTL int `json:"message_ttl"`
+
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+
+	// Public rooms have no password and are listed in the room directory.
+	Public bool     `json:"public"`
+	Tags   []string `json:"tags"`
+
+	// Settings of the room that override the app's defaults.
+	Settings *reqRoomSettings `json:"settings"`
+}
+
+// reqPassword represents a change of a room's password. RevokeSessions logs
+// out all the peers but the one changing it.
+type reqPassword struct {
+	Password       string `json:"password"`
+	RevokeSessions bool   `json:"revoke_sessions"`
+}
+
+// reqRoomSettings represents the settings of a new room. Settings that
+// aren't set are left at the app's defaults.
+type reqRoomSettings struct {
+	MaxPeers          *int `json:"max_peers"`
+	MaxCachedMessages *int `json:"max_cached_messages"`
+	MaxMessageLen     *int `json:"max_message_length"`
+	RateLimitMessages *int `json:"rate_limit_messages"`
+
+	// Durations (seconds).
+	RateLimitInterval *int `json:"rate_limit_interval"`
+	RoomAge           *int `json:"room_age"`
+}
+
+type reqInvite struct {
+	MaxUses int `json:"max_uses"`
+
+	// Expiry of the invite (seconds).
+	TTL int `json:"ttl"`
+}
+
+// respInvite is an invite along with its link.
+type respInvite struct {
+	hub.Invite
+	URL string `json:"url"`
+}
+
+type reqNotice struct {
+	RoomID  string `json:"room_id"`
+	Message string `json:"message"`
+	Record  bool   `json:"record"`
+}
+
+// Size allowed in file uploads in addition to the file for the multipart
+// encoding.
+const fileUploadOverhead = 1 << 16
+
+// Maximum number of tags of a public room.
+const maxRoomTags = 5
+
+// reTag matches valid room tags.
+var reTag = regexp.MustCompile(`^[a-z0-9\-]{2,20}$`)
+
+// inlineFileTypes are the types of shared files that are safe to be
+// displayed inline.
+var inlineFileTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
 }
 
 var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
@@ -70,6 +170,40 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 	}, http.StatusOK, w, app)
 }
 
+// handleRoomsPage renders the directory of public rooms.
+func handleRoomsPage(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+		tag = r.URL.Query().Get("tag")
+	)
+
+	if !app.cfg.RoomDirectory {
+		http.NotFound(w, r)
+		return
+	}
+
+	respondHTML("rooms", tplData{
+		Title: "Public rooms",
+		Rooms: app.hub.PublicRooms(tag),
+		Tag:   tag,
+	}, http.StatusOK, w, app)
+}
+
+// handleGetRooms returns the public rooms in the room directory.
+func handleGetRooms(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	if !app.cfg.RoomDirectory {
+		respondJSON(w, nil, errors.New("the room directory is disabled"), http.StatusNotFound)
+		return
+	}
+	respondJSON(w, app.hub.PublicRooms(r.URL.Query().Get("tag")), nil, http.StatusOK)
+}
+
 // handleRoomPage renders the chat room page.
 func handleRoomPage(w http.ResponseWriter, r *http.Request) {
 	var (
@@ -84,7 +218,7 @@ func handleRoomPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	out := tplData{
-		Title: room.Name,
+		Title: room.Name(),
 		Room:  room,
 	}
 	if ctx.sess.ID != "" {
@@ -117,39 +251,287 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Handle == "" {
-		h, err := hub.GenerateGUID(8)
-		if err != nil {
-			app.logger.Printf("error generating uniq handle: %v", err)
-			respondJSON(w, nil, errors.New("error generating uniq handle"), http.StatusInternalServerError)
+	// Check if the peer's handle or IP has been banned from the room. Handle
+	// bans are advisory as a banned peer can pick another handle.
+	banned, err := app.hub.Store.IsBanned(room.ID, req.Handle, clientIP(r, app.cfg))
+	if err != nil {
+		app.logger.Printf("error checking ban: %v", err)
+		respondJSON(w, nil, errors.New("error checking ban"), http.StatusInternalServerError)
+		return
+	}
+	if banned {
+		respondJSON(w, nil, errors.New("you are banned from this room"), http.StatusForbidden)
+		return
+	}
+
+	// Validate password. Public rooms don't have one.
+	if !room.Public {
+		if err := bcrypt.CompareHashAndPassword(room.PasswordHash(), []byte(req.Password)); err != nil {
+			respondJSON(w, nil, errors.New("incorrect password"), http.StatusForbidden)
 			return
 		}
-		req.Handle = h
 	}
 
-	// Validate password.
-	if err := bcrypt.CompareHashAndPassword(room.Password, []byte(req.Password)); err != nil {
-		respondJSON(w, nil, errors.New("incorrect password"), http.StatusForbidden)
+	// Locked rooms don't admit new peers.
+	if room.Locked() {
+		respondJSON(w, nil, errors.New("this room is locked"), http.StatusForbidden)
 		return
 	}
 
 	// Register a new session for the peer in the DB.
-	sessID, err := hub.GenerateGUID(32)
+	if err := createSession(w, app, room, req.Handle, hub.RolePeer); err != nil {
+		respondJSON(w, nil, err, http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleInvitePage renders the room page for a peer who's opened an invite
+// link. Peers who are already logged in are sent to the room.
+func handleInvitePage(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondHTML("room-not-found", tplData{}, http.StatusNotFound, w, app)
+		return
+	}
+	if ctx.sess.ID != "" {
+		http.Redirect(w, r, "/r/"+room.ID, http.StatusFound)
+		return
+	}
+
+	// Disable browser caching.
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	respondHTML("room", tplData{
+		Title:  room.Name(),
+		Room:   room,
+		Invite: chi.URLParam(r, "token"),
+	}, http.StatusOK, w, app)
+}
+
+// handleInviteLogin logs a peer into a room with an invite instead of the
+// room's password.
+func handleInviteLogin(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+
+	var req reqRoom
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	// Check if the peer's handle or IP has been banned from the room before
+	// using up the invite.
+	banned, err := app.hub.Store.IsBanned(room.ID, req.Handle, clientIP(r, app.cfg))
 	if err != nil {
-		app.logger.Printf("error generating session ID: %v", err)
-		respondJSON(w, nil, errors.New("error generating session ID"), http.StatusInternalServerError)
+		app.logger.Printf("error checking ban: %v", err)
+		respondJSON(w, nil, errors.New("error checking ban"), http.StatusInternalServerError)
+		return
+	}
+	if banned {
+		respondJSON(w, nil, errors.New("you are banned from this room"), http.StatusForbidden)
 		return
 	}
 
-	if err := app.hub.Store.AddSession(sessID, req.Handle, room.ID, app.cfg.RoomAge); err != nil {
-		app.logger.Printf("error creating session: %v", err)
-		respondJSON(w, nil, errors.New("error creating session"), http.StatusInternalServerError)
+	// Locked rooms don't admit new peers.
+	if room.Locked() {
+		respondJSON(w, nil, errors.New("this room is locked"), http.StatusForbidden)
 		return
 	}
 
-	// Set the session cookie.
-	ck := &http.Cookie{Name: app.cfg.SessionCookie, Value: sessID, Path: "/"}
-	http.SetCookie(w, ck)
+	s, err := addSession(app, room, req.Handle, hub.RolePeer)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusInternalServerError)
+		return
+	}
+
+	// The invite is used last so that it isn't used up by a login that
+	// fails. The session is discarded if the invite is no longer valid.
+	if err := app.hub.UseInvite(room.ID, chi.URLParam(r, "token")); err != nil {
+		if err := app.hub.Store.RemoveSession(s.ID, room.ID); err != nil {
+			app.logger.Printf("error removing session: %v", err)
+		}
+
+		code := http.StatusInternalServerError
+		if errors.Is(err, store.ErrInviteNotFound) {
+			code = http.StatusForbidden
+		}
+		respondJSON(w, nil, err, code)
+		return
+	}
+
+	setSessionCookie(w, app, s.ID)
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleCreateInvite mints an invite to a room on behalf of its owner.
+func handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if !hasRoomRole(w, ctx, hub.RoleOwner) {
+		return
+	}
+
+	var req reqInvite
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	// Invites are one-time and last for a day unless specified.
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	ttl := time.Duration(req.TTL) * time.Second
+	if req.TTL == 0 {
+		ttl = time.Hour * 24
+	}
+
+	inv, err := app.hub.CreateInvite(room.ID, req.MaxUses, ttl)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+	respondJSON(w, makeInviteResp(app, room.ID, inv), nil, http.StatusOK)
+}
+
+// handleGetInvites returns the unexpired invites to a room to its owner.
+func handleGetInvites(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if !hasRoomRole(w, ctx, hub.RoleOwner) {
+		return
+	}
+
+	invs, err := app.hub.Invites(room.ID)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]respInvite, 0, len(invs))
+	for _, inv := range invs {
+		out = append(out, makeInviteResp(app, room.ID, inv))
+	}
+	respondJSON(w, out, nil, http.StatusOK)
+}
+
+// handleRevokeInvite deletes an invite to a room on behalf of its owner.
+func handleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if !hasRoomRole(w, ctx, hub.RoleOwner) {
+		return
+	}
+
+	if err := app.hub.RevokeInvite(room.ID, chi.URLParam(r, "inviteID")); err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, store.ErrInviteNotFound) {
+			code = http.StatusNotFound
+		}
+		respondJSON(w, nil, err, code)
+		return
+	}
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleUpdateRoom changes a room's name, topic, or description on behalf of
+// its owner or moderators.
+func handleUpdateRoom(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		room = ctx.room
+	)
+
+	if !hasRoomRole(w, ctx, hub.RoleOwner, hub.RoleModerator) {
+		return
+	}
+
+	var req hub.RoomUpdate
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	s := store.Sess{PeerID: ctx.sess.PeerID, Handle: ctx.sess.Handle}
+	if err := room.Update(s, req); err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+	respondJSON(w, room.Info(), nil, http.StatusOK)
+}
+
+// handleChangePassword changes a room's password on behalf of its owner.
+func handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if !hasRoomRole(w, ctx, hub.RoleOwner) {
+		return
+	}
+
+	var req reqPassword
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Password) < 6 || len(req.Password) > 100 {
+		respondJSON(w, nil, errors.New("invalid password (6 - 100 chars)"), http.StatusBadRequest)
+		return
+	}
+
+	// Hash the password.
+	pwdHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), 8)
+	if err != nil {
+		app.logger.Printf("error hashing password: %v", err)
+		respondJSON(w, nil, errors.New("error hashing password"), http.StatusInternalServerError)
+		return
+	}
+
+	s := store.Sess{
+		ID:     ctx.sess.ID,
+		PeerID: ctx.sess.PeerID,
+		Handle: ctx.sess.Handle,
+		Role:   ctx.sess.Role,
+		Muted:  ctx.sess.Muted,
+
+		CreatedAt: ctx.sess.CreatedAt,
+	}
+	if err := room.SetPassword(s, pwdHash, req.RevokeSessions); err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
 	respondJSON(w, true, nil, http.StatusOK)
 }
 
@@ -198,8 +580,20 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A reconnecting peer sends the sequence number of the last payload it
+	// received to get only the ones it's missed.
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+
 	// Create a new peer instance and add to the room.
-	room.AddPeer(ctx.sess.ID, ctx.sess.Handle, ws)
+	room.AddPeer(store.Sess{
+		ID:     ctx.sess.ID,
+		PeerID: ctx.sess.PeerID,
+		Handle: ctx.sess.Handle,
+		Role:   ctx.sess.Role,
+		Muted:  ctx.sess.Muted,
+
+		CreatedAt: ctx.sess.CreatedAt,
+	}, ws, clientIP(r, app.cfg), since)
 }
 
 // respondJSON responds to an HTTP request with a generic payload or an error.
@@ -255,27 +649,91 @@ func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Name != "" && (len(req.Name) < 3 || len(req.Name) > 100) {
-		respondJSON(w, nil, errors.New("invalid room name (6 - 100 chars)"), http.StatusBadRequest)
+	info := hub.RoomInfo{
+		Name:        strings.TrimSpace(req.Name),
+		Topic:       strings.TrimSpace(req.Topic),
+		Description: strings.TrimSpace(req.Description),
+	}
+	if err := info.Validate(); err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
 		return
 	}
 
-	if len(req.Password) < 6 || len(req.Password) > 100 {
-		respondJSON(w, nil, errors.New("invalid password (6 - 100 chars)"), http.StatusBadRequest)
+	var (
+		pwdHash []byte
+		tags    []string
+	)
+	if req.Public {
+		if req.Password != "" {
+			respondJSON(w, nil, errors.New("public rooms can't have passwords"), http.StatusBadRequest)
+			return
+		}
+		// The secret of an E2E room is in its link, which the directory can't have.
+		if req.E2E {
+			respondJSON(w, nil, errors.New("public rooms can't be end-to-end encrypted"), http.StatusBadRequest)
+			return
+		}
+		t, err := cleanTags(req.Tags)
+		if err != nil {
+			respondJSON(w, nil, err, http.StatusBadRequest)
+			return
+		}
+		tags = t
+	} else {
+		if len(req.Password) < 6 || len(req.Password) > 100 {
+			respondJSON(w, nil, errors.New("invalid password (6 - 100 chars)"), http.StatusBadRequest)
+			return
+		}
+
+		// Hash the password.
+		h, err := bcrypt.GenerateFromPassword([]byte(req.Password), 8)
+		if err != nil {
+			app.logger.Printf("error hashing password: %v", err)
+			respondJSON(w, "Error hashing password", nil, http.StatusInternalServerError)
+			return
+		}
+		pwdHash = h
+	}
+
+	msgTTL := time.Duration(req.MessageTTL) * time.Second
+	if msgTTL < 0 || msgTTL > hub.MaxMessageTTL {
+		respondJSON(w, nil, errors.New("invalid message expiry"), http.StatusBadRequest)
 		return
 	}
 
-	// Hash the password.
-	pwdHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), 8)
-	if err != nil {
-		app.logger.Printf("error hashing password: %v", err)
-		respondJSON(w, "Error hashing password", nil, http.StatusInternalServerError)
+	settings := app.hub.DefaultSettings()
+	if req.Settings != nil {
+		req.Settings.apply(&settings)
+	}
+	if err := app.hub.CheckSettings(settings); err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
 		return
 	}
 
 	// Create and activate the new room.
-	room, err := app.hub.AddRoom(req.Name, pwdHash)
+	room, err := app.hub.AddRoom(store.Room{
+		Name:       info.Name,
+		Password:   pwdHash,
+		E2E:        req.E2E,
+		MessageTTL: msgTTL,
+
+		Topic:       info.Topic,
+		Description: info.Description,
+		Public:      req.Public,
+		Tags:        tags,
+		Settings:    &settings,
+	})
 	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, hub.ErrRoomLimit) {
+			code = http.StatusServiceUnavailable
+		}
+		respondJSON(w, nil, err, code)
+		return
+	}
+
+	// Log the creator into the room as its owner.
+	if err := createSession(w, app, room, req.Handle, hub.RoleOwner); err != nil {
 		respondJSON(w, nil, err, http.StatusInternalServerError)
 		return
 	}
@@ -285,6 +743,154 @@ func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 	}{room.ID}, nil, http.StatusOK)
 }
 
+// handleNotice sends a server notice to a room, or to all active rooms if
+// no room is specified.
+func handleNotice(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	var req reqNotice
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	if req.Message == "" || len(req.Message) > app.cfg.MaxMessageLen {
+		respondJSON(w, nil, errors.New("invalid message"), http.StatusBadRequest)
+		return
+	}
+
+	// Send the notice to all rooms.
+	if req.RoomID == "" {
+		n := app.hub.NoticeAll(req.Message, req.Record)
+		respondJSON(w, struct {
+			Rooms int `json:"rooms"`
+		}{n}, nil, http.StatusOK)
+		return
+	}
+
+	if err := app.hub.Notice(req.RoomID, req.Message, req.Record); err != nil {
+		respondJSON(w, nil, err, http.StatusNotFound)
+		return
+	}
+	respondJSON(w, struct {
+		Rooms int `json:"rooms"`
+	}{1}, nil, http.StatusOK)
+}
+
+// handleUploadFile stores a file shared by a peer in a room.
+func handleUploadFile(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+	if ctx.sess.Muted {
+		respondJSON(w, nil, errors.New("you are muted in this room"), http.StatusForbidden)
+		return
+	}
+	if app.hub.Files == nil {
+		respondJSON(w, nil, hub.ErrFilesDisabled, http.StatusBadRequest)
+		return
+	}
+
+	// Leave room for the multipart encoding around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, app.cfg.MaxFileSize+fileUploadOverhead)
+	f, hdr, err := r.FormFile("file")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			respondJSON(w, nil, hub.ErrFileTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		respondJSON(w, nil, errors.New("invalid file"), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(io.LimitReader(f, app.cfg.MaxFileSize+1))
+	if err != nil {
+		respondJSON(w, nil, errors.New("error reading file"), http.StatusBadRequest)
+		return
+	}
+	if len(b) == 0 {
+		respondJSON(w, nil, errors.New("file is empty"), http.StatusBadRequest)
+		return
+	}
+
+	out, err := room.AddFile(store.Sess{
+		ID:     ctx.sess.ID,
+		PeerID: ctx.sess.PeerID,
+		Handle: ctx.sess.Handle,
+		Role:   ctx.sess.Role,
+	}, hdr.Filename, b)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, hub.ErrFileTooLarge), errors.Is(err, hub.ErrFilesQuota):
+			code = http.StatusRequestEntityTooLarge
+		case errors.Is(err, hub.ErrFilesFull):
+			code = http.StatusInsufficientStorage
+		case errors.Is(err, hub.ErrFilesRate):
+			code = http.StatusTooManyRequests
+		case errors.Is(err, hub.ErrFilesDisabled), errors.Is(err, hub.ErrFilesE2E):
+			code = http.StatusBadRequest
+		case errors.Is(err, hub.ErrRoomNotFound):
+			code = http.StatusNotFound
+		}
+		respondJSON(w, nil, err, code)
+		return
+	}
+	respondJSON(w, out, nil, http.StatusOK)
+}
+
+// handleGetFile serves a file shared in a room. Only images are displayed
+// inline and everything else is downloaded so that the files can't run
+// scripts on the app's origin.
+func handleGetFile(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		room = ctx.room
+	)
+
+	if room == nil || ctx.sess.ID == "" {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	f, b, err := room.GetFile(chi.URLParam(r, "fileID"))
+	if err != nil {
+		if !errors.Is(err, blob.ErrFileNotFound) {
+			ctx.app.logger.Printf("error getting file: %v", err)
+		}
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	disp := "attachment"
+	if inlineFileTypes[f.Type] {
+		disp = "inline"
+	}
+
+	w.Header().Set("Content-Type", f.Type)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disp, map[string]string{"filename": f.Name}))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(b)
+}
+
 // wrap is a middleware that handles auth and room check for various HTTP handlers.
 // It attaches the app and room contexts to handlers.
 func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
@@ -294,6 +900,17 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 			roomID = chi.URLParam(r, "roomID")
 		)
 
+		// Check if the request has the admin token. Admin APIs are disabled
+		// if there's no token in the config.
+		if opts&hasAdmin != 0 {
+			tk := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if app.cfg.AdminToken == "" ||
+				subtle.ConstantTimeCompare([]byte(tk), []byte(app.cfg.AdminToken)) != 1 {
+				respondJSON(w, nil, errors.New("invalid admin token"), http.StatusForbidden)
+				return
+			}
+		}
+
 		// Check if the request is authenticated.
 		if opts&hasAuth != 0 {
 			ck, _ := r.Cookie(app.cfg.SessionCookie)
@@ -306,7 +923,12 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 				}
 				req.sess = sess{
 					ID:     s.ID,
+					PeerID: s.PeerID,
 					Handle: s.Handle,
+					Role:   s.Role,
+					Muted:  s.Muted,
+
+					CreatedAt: s.CreatedAt,
 				}
 			}
 		}
@@ -317,6 +939,17 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 			// handler. It's the handler's responsibility to throw an error,
 			// API or HTML response.
 			room, err := app.hub.ActivateRoom(roomID)
+			if errors.Is(err, hub.ErrRoomLimit) {
+				if opts&isPage != 0 {
+					respondHTML("error", tplData{
+						Title:       "Server is full",
+						Description: "There are too many rooms on the server. Try again later.",
+					}, http.StatusServiceUnavailable, w, app)
+					return
+				}
+				respondJSON(w, nil, err, http.StatusServiceUnavailable)
+				return
+			}
 			if err == nil {
 				req.room = room
 			}
@@ -328,6 +961,147 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 	})
 }
 
+// createSession registers a new peer session with the given role in a room
+// and sets the session cookie.
+func createSession(w http.ResponseWriter, app *App, room *hub.Room, handle, role string) error {
+	s, err := addSession(app, room, handle, role)
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, app, s.ID)
+	return nil
+}
+
+// addSession registers a new peer session with the given role in a room.
+func addSession(app *App, room *hub.Room, handle, role string) (store.Sess, error) {
+	if handle == "" {
+		h, err := hub.GenerateGUID(8)
+		if err != nil {
+			app.logger.Printf("error generating uniq handle: %v", err)
+			return store.Sess{}, errors.New("error generating uniq handle")
+		}
+		handle = h
+	}
+
+	sessID, err := hub.GenerateGUID(32)
+	if err != nil {
+		app.logger.Printf("error generating session ID: %v", err)
+		return store.Sess{}, errors.New("error generating session ID")
+	}
+
+	// Public ID by which other peers know this peer.
+	peerID, err := hub.GenerateGUID(16)
+	if err != nil {
+		app.logger.Printf("error generating peer ID: %v", err)
+		return store.Sess{}, errors.New("error generating peer ID")
+	}
+
+	s := store.Sess{
+		ID:     sessID,
+		PeerID: peerID,
+		Handle: handle,
+		Role:   role,
+
+		CreatedAt: time.Now(),
+	}
+	if err := app.hub.Store.AddSession(s, room.ID, room.Settings().RoomAge); err != nil {
+		app.logger.Printf("error creating session: %v", err)
+		return store.Sess{}, errors.New("error creating session")
+	}
+	return s, nil
+}
+
+// setSessionCookie sets the cookie of a peer session.
+func setSessionCookie(w http.ResponseWriter, app *App, sessID string) {
+	ck := &http.Cookie{Name: app.cfg.SessionCookie, Value: sessID, Path: "/"}
+	http.SetCookie(w, ck)
+}
+
+// apply overrides the given settings with the ones that are set.
+func (s reqRoomSettings) apply(out *store.RoomSettings) {
+	if s.MaxPeers != nil {
+		out.MaxPeers = *s.MaxPeers
+	}
+	if s.MaxCachedMessages != nil {
+		out.MaxCachedMessages = *s.MaxCachedMessages
+	}
+	if s.MaxMessageLen != nil {
+		out.MaxMessageLen = *s.MaxMessageLen
+	}
+	if s.RateLimitMessages != nil {
+		out.RateLimitMessages = *s.RateLimitMessages
+	}
+	if s.RateLimitInterval != nil {
+		out.RateLimitInterval = time.Duration(*s.RateLimitInterval) * time.Second
+	}
+	if s.RoomAge != nil {
+		out.RoomAge = time.Duration(*s.RoomAge) * time.Second
+	}
+}
+
+// cleanTags lowercases and validates the tags of a public room, dropping
+// duplicates.
+func cleanTags(tags []string) ([]string, error) {
+	if len(tags) > maxRoomTags {
+		return nil, fmt.Errorf("too many tags (up to %d)", maxRoomTags)
+	}
+
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if !reTag.MatchString(t) {
+			return nil, errors.New("invalid tag. Use 2 to 20 letters, numbers, or -")
+		}
+		if !slices.Contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// hasRoomRole checks whether a request is from a peer with one of the given
+// roles in a valid room and responds with an error if it isn't.
+func hasRoomRole(w http.ResponseWriter, ctx *reqCtx, roles ...string) bool {
+	if ctx.room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return false
+	}
+	if ctx.sess.ID == "" || !slices.Contains(roles, ctx.sess.Role) {
+		respondJSON(w, nil, errors.New("you are not permitted to do that"), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// clientIP returns the IP of the client that sent a request, which is banned
+// along with its handle, or an empty string if IP bans are disabled. Behind
+// a reverse proxy, it's the last IP in the trusted header, which is the one
+// that the proxy has added.
+func clientIP(r *http.Request, cfg *hub.Config) string {
+	if !cfg.BanIP {
+		return ""
+	}
+
+	if cfg.TrustedProxyHeader != "" {
+		v := r.Header.Get(cfg.TrustedProxyHeader)
+		if i := strings.LastIndexByte(v, ','); i >= 0 {
+			v = v[i+1:]
+		}
+		return strings.TrimSpace(v)
+	}
+
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return ip
+}
+
+// makeInviteResp attaches the link to an invite.
+func makeInviteResp(app *App, roomID string, inv hub.Invite) respInvite {
+	return respInvite{
+		Invite: inv,
+		URL:    app.cfg.RootURL + "/r/" + roomID + "/invite/" + inv.Token,
+	}
+}
+
 // readJSONReq reads the JSON body from a request and unmarshals it to the given target.
 func readJSONReq(r *http.Request, o any) error {
 	defer r.Body.Close()
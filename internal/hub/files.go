@@ -0,0 +1,211 @@
+package hub
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/knadh/niltalk/blob"
+	"github.com/knadh/niltalk/store"
+)
+
+const (
+	// Maximum length of the name of a shared file in runes.
+	maxFileNameLen = 100
+
+	// Interval at which the files of rooms that have expired in the store
+	// are cleaned up.
+	filesCleanupInterval = time.Hour
+)
+
+// Errors returned when a file can't be shared in a room.
+var (
+	ErrFilesDisabled = errors.New("file sharing is disabled")
+	ErrFilesE2E      = errors.New("files can't be shared in end-to-end encrypted rooms")
+	ErrFileTooLarge  = errors.New("file is too large")
+	ErrFilesQuota    = errors.New("the room has run out of space for files")
+	ErrFilesFull     = errors.New("the server has run out of space for files. Try again later")
+	ErrFilesRate     = errors.New("you are sharing files too fast. Slow down")
+)
+
+// AddFile stores a file shared by a peer in the room and queues it to be
+// broadcast to the room. Files are limited to app.max_file_size, the files in
+// a room to app.max_room_files_size, and all the files to app.max_files_size.
+// Every file takes from the peer's rate limit like a message. Files expire
+// like messages in rooms with a message TTL and are deleted along with the
+// room.
+func (r *Room) AddFile(s store.Sess, name string, b []byte) (blob.File, error) {
+	if r.hub.Files == nil {
+		return blob.File{}, ErrFilesDisabled
+	}
+	if r.E2E {
+		return blob.File{}, ErrFilesE2E
+	}
+	if int64(len(b)) > r.hub.cfg.MaxFileSize {
+		return blob.File{}, ErrFileTooLarge
+	}
+	if !r.takeToken(s.PeerID) {
+		return blob.File{}, ErrFilesRate
+	}
+
+	id, err := GenerateGUID(16)
+	if err != nil {
+		r.hub.log.Printf("error generating file ID: %v", err)
+		return blob.File{}, errors.New("error generating file ID")
+	}
+
+	// The type is always detected as the one sent by the peer can't be trusted.
+	f := blob.File{
+		ID:   id,
+		Name: cleanFileName(name),
+		Type: http.DetectContentType(b),
+		Size: int64(len(b)),
+	}
+
+	// Concurrent uploads to the room shouldn't exceed the quota together.
+	r.filesMu.Lock()
+	defer r.filesMu.Unlock()
+
+	n, err := r.hub.Files.RoomSize(r.ID)
+	if err != nil {
+		r.hub.log.Printf("error getting room files size: %v", err)
+		return blob.File{}, errors.New("error storing file")
+	}
+	if n+f.Size > r.hub.cfg.MaxRoomFilesSize {
+		return blob.File{}, ErrFilesQuota
+	}
+
+	r.hub.filesMu.Lock()
+	defer r.hub.filesMu.Unlock()
+
+	n, err = r.hub.Files.Size()
+	if err != nil {
+		r.hub.log.Printf("error getting files size: %v", err)
+		return blob.File{}, errors.New("error storing file")
+	}
+	if n+f.Size > r.hub.cfg.MaxFilesSize {
+		return blob.File{}, ErrFilesFull
+	}
+
+	// The room's files may have been removed along with it by now.
+	if r.closed() {
+		return blob.File{}, ErrRoomNotFound
+	}
+
+	if err := r.hub.Files.Put(r.ID, f, b); err != nil {
+		r.hub.log.Printf("error storing file: %v", err)
+		return blob.File{}, errors.New("error storing file")
+	}
+
+	m := &payloadMsgFile{
+		ID:         f.ID,
+		PeerID:     s.PeerID,
+		PeerHandle: s.Handle,
+		Name:       f.Name,
+		Type:       f.Type,
+		Size:       f.Size,
+		URL:        fmt.Sprintf("/api/rooms/%s/files/%s", r.ID, f.ID),
+	}
+	if r.MessageTTL > 0 {
+		t := time.Now().Add(r.MessageTTL)
+		m.ExpiresAt = &t
+	}
+
+	r.markActive()
+	r.queueReq(peerReq{reqType: TypeFile, file: m})
+	r.hub.log.Printf("%s@%s shared a file (%d bytes) in %s", s.Handle, s.PeerID, f.Size, r.ID)
+
+	return f, nil
+}
+
+// shareFile records a shared file and broadcasts it to the room from within
+// the room's event loop.
+func (r *Room) shareFile(m *payloadMsgFile) {
+	if m.ExpiresAt != nil {
+		heap.Push(&r.expiries, expiry{at: *m.ExpiresAt, id: m.ID, file: true})
+	}
+
+	c := r.recordPayload(cachedPayload{data: r.makePayload(m, TypeFile), fileID: m.ID})
+	r.broadcast(c.data, false)
+}
+
+// removeFile deletes an expired file from the room's payload cache, its
+// history, and the blob store.
+func (r *Room) removeFile(id string) {
+	if n := r.findFile(id); n >= 0 {
+		r.removeMessage(n)
+	}
+	if err := r.hub.Files.Remove(r.ID, id); err != nil {
+		r.hub.log.Printf("error removing file: %v", err)
+	}
+}
+
+// findFile returns the index of the shared file with the given ID in the
+// payload cache or -1 if it's not there.
+func (r *Room) findFile(id string) int {
+	for n, c := range r.payloadCache {
+		if c.fileID == id {
+			return n
+		}
+	}
+	return -1
+}
+
+// GetFile returns a file shared in the room.
+func (r *Room) GetFile(id string) (blob.File, []byte, error) {
+	if r.hub.Files == nil {
+		return blob.File{}, nil, blob.ErrFileNotFound
+	}
+	return r.hub.Files.Get(r.ID, id)
+}
+
+// watchFiles periodically deletes the files of rooms that have expired in
+// the store without being active on the hub (eg: after a restart).
+func (h *Hub) watchFiles() {
+	t := time.NewTicker(filesCleanupInterval)
+	defer t.Stop()
+	for range t.C {
+		h.cleanupFiles()
+	}
+}
+
+// cleanupFiles deletes the files of rooms that no longer exist in the store.
+func (h *Hub) cleanupFiles() {
+	rooms, err := h.Files.Rooms()
+	if err != nil {
+		h.log.Printf("error listing rooms with files: %v", err)
+		return
+	}
+
+	for _, id := range rooms {
+		ok, err := h.Store.RoomExists(id)
+		if err != nil || ok {
+			continue
+		}
+		if err := h.Files.RemoveRoom(id); err != nil {
+			h.log.Printf("error removing files of room %s: %v", id, err)
+		}
+	}
+}
+
+// cleanFileName strips the path and control characters from the name of
+// a shared file and truncates it.
+func cleanFileName(name string) string {
+	name = strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) {
+			return -1
+		}
+		return c
+	}, filepath.Base(strings.ReplaceAll(name, `\`, "/")))
+
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return makeSnippet(name, maxFileNameLen)
+}
@@ -4,9 +4,12 @@ import (
 	"crypto/rand"
 	"errors"
 	"log"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/knadh/niltalk/blob"
 	"github.com/knadh/niltalk/store"
 )
 
@@ -14,79 +17,206 @@ import (
 const (
 	TypeTyping          = "typing"
 	TypeMessage         = "message"
+	TypeMessageDirect   = "message.direct"
+	TypeMessageEdit     = "message.edit"
+	TypeMessageDelete   = "message.delete"
+	TypeMessageReact    = "message.react"
+	TypeMessageRead     = "message.read"
+	TypeMessageExpire   = "message.expire"
 	TypePeerList        = "peer.list"
 	TypePeerInfo        = "peer.info"
 	TypePeerJoin        = "peer.join"
 	TypePeerLeave       = "peer.leave"
+	TypePeerKick        = "peer.kick"
+	TypePeerBan         = "peer.ban"
+	TypePeerMute        = "peer.mute"
+	TypePeerUnmute      = "peer.unmute"
 	TypePeerRateLimited = "peer.ratelimited"
+	TypePeerWarning     = "peer.warning"
+	TypePeerSlow        = "peer.slow"
+	TypePeerRole        = "peer.role"
+	TypePeerRevoked     = "peer.revoked"
 	TypeRoomDispose     = "room.dispose"
 	TypeRoomFull        = "room.full"
+	TypeRoomLock        = "room.lock"
+	TypeRoomUnlock      = "room.unlock"
+	TypeRoomLocked      = "room.locked"
+	TypeRoomUpdate      = "room.update"
+	TypeRoomPassword    = "room.password"
+	TypeTruncated       = "history.truncated"
 	TypeNotice          = "notice"
 	TypeHandle          = "handle"
+	TypeFile            = "file"
+	TypeError           = "error"
 )
 
+// Roles of peers in a room.
+const (
+	RolePeer      = "peer"
+	RoleModerator = "moderator"
+	RoleOwner     = "owner"
+)
+
+// privileges lists the roles that are permitted to send privileged message
+// types. Types that aren't listed here are open to all peers.
+var privileges = map[string][]string{
+	TypeRoomDispose: {RoleOwner, RoleModerator},
+	TypePeerRole:    {RoleOwner},
+	TypeRoomLock:    {RoleOwner},
+	TypeRoomUnlock:  {RoleOwner},
+	TypeRoomUpdate:  {RoleOwner, RoleModerator},
+	TypePeerKick:    {RoleOwner, RoleModerator},
+	TypePeerBan:     {RoleOwner, RoleModerator},
+	TypePeerMute:    {RoleOwner, RoleModerator},
+	TypePeerUnmute:  {RoleOwner, RoleModerator},
+}
+
+// roleRanks ranks roles. Privileged peers can only act on peers of a lower rank.
+var roleRanks = map[string]int{
+	RolePeer:      0,
+	RoleModerator: 1,
+	RoleOwner:     2,
+}
+
+// Policies applied when app.max_rooms is reached.
+const (
+	RoomLimitReject    = "reject"
+	RoomLimitEvictIdle = "evict_idle"
+)
+
+// Policies applied when a peer's outbound queue (app.max_message_queue)
+// is full.
+const (
+	SlowPeerDropOldest = "drop_oldest"
+	SlowPeerDropNewest = "drop_newest"
+	SlowPeerDisconnect = "disconnect"
+)
+
+// MaxMessageTTL is the longest expiry that can be set on messages.
+const MaxMessageTTL = time.Hour * 24
+
+// ErrRoomLimit is returned when a room can't be created or activated as
+// the maximum number of rooms has been reached.
+var ErrRoomLimit = errors.New("too many rooms on the server. Try again later")
+
+// ErrRoomNotFound is returned when a room isn't active on the hub.
+var ErrRoomNotFound = errors.New("room not found")
+
 // Config represents the app configuration.
 type Config struct {
 	Address string `koanf:"address"`
 	RootURL string `koanf:"root_url"`
 
-	Name              string        `koanf:"name"`
-	RoomIDLen         int           `koanf:"room_id_length"`
-	MaxCachedMessages int           `koanf:"max_cached_messages"`
-	MaxMessageLen     int           `koanf:"max_message_length"`
-	WSTimeout         time.Duration `koanf:"websocket_timeout"`
-	MaxMessageQueue   int           `koanf:"max_message_queue"`
-	RateLimitInterval time.Duration `koanf:"rate_limit_interval"`
-	RateLimitMessages int           `koanf:"rate_limit_messages"`
-	MaxRooms          int           `koanf:"max_rooms"`
-	MaxPeersPerRoom   int           `koanf:"max_peers_per_room"`
-	PeerHandleFormat  string        `koanf:"peer_handle_format"`
-	RoomTimeout       time.Duration `koanf:"room_timeout"`
-	RoomAge           time.Duration `koanf:"room_age"`
-	SessionCookie     string        `koanf:"session_cookie"`
-	Storage           string        `koanf:"storage"`
-}
-
-// Hub acts as the controller and container for all chat rooms.
+	Name                   string        `koanf:"name"`
+	RoomIDLen              int           `koanf:"room_id_length"`
+	MaxCachedMessages      int           `koanf:"max_cached_messages"`
+	PersistHistory         bool          `koanf:"persist_history"`
+	MaxMessageLen          int           `koanf:"max_message_length"`
+	WSTimeout              time.Duration `koanf:"websocket_timeout"`
+	MaxMessageQueue        int           `koanf:"max_message_queue"`
+	SlowPeerPolicy         string        `koanf:"slow_peer_policy"`
+	RateLimitInterval      time.Duration `koanf:"rate_limit_interval"`
+	RateLimitMessages      int           `koanf:"rate_limit_messages"`
+	RateLimitMuteDuration  time.Duration `koanf:"rate_limit_mute_duration"`
+	RateLimitMaxViolations int           `koanf:"rate_limit_max_violations"`
+	MaxRooms               int           `koanf:"max_rooms"`
+	RoomLimitPolicy        string        `koanf:"room_limit_policy"`
+	MaxPeersPerRoom        int           `koanf:"max_peers_per_room"`
+	PeerHandleFormat       string        `koanf:"peer_handle_format"`
+	RoomTimeout            time.Duration `koanf:"room_timeout"`
+	RoomAge                time.Duration `koanf:"room_age"`
+	BanDuration            time.Duration `koanf:"ban_duration"`
+	BanIP                  bool          `koanf:"ban_ip"`
+	TrustedProxyHeader     string        `koanf:"trusted_proxy_header"`
+	RoomMaxAge             time.Duration `koanf:"room_max_age"`
+	SessionCookie          string        `koanf:"session_cookie"`
+	AdminToken             string        `koanf:"admin_token"`
+	Storage                string        `koanf:"storage"`
+	MaxFileSize            int64         `koanf:"max_file_size"`
+	MaxRoomFilesSize       int64         `koanf:"max_room_files_size"`
+	MaxFilesSize           int64         `koanf:"max_files_size"`
+	FileStorage            string        `koanf:"file_storage"`
+	RoomDirectory          bool          `koanf:"room_directory"`
+	RoomLimits             RoomLimits    `koanf:"room_limits"`
+}
+
+// PublicRoom represents an active public room in the room directory.
+type PublicRoom struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	Peers       int       `json:"peers"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Hub acts as the controller and container for all chat rooms. Files is nil
+// if file sharing is disabled.
 type Hub struct {
 	Store store.Store
+	Files blob.Store
 	rooms map[string]*Room
 
 	cfg *Config
 	mut sync.RWMutex
 	log *log.Logger
+
+	// Number of rooms that have been admitted but not yet added to the hub,
+	// and the rooms that are being evicted to make way for others.
+	pending  int
+	evicting map[string]bool
+
+	// Serializes the uploads of files across rooms to keep them within
+	// app.max_files_size.
+	filesMu sync.Mutex
+
+	// Key that signs invites to rooms, loaded lazily.
+	invKey []byte
+	keyMut sync.Mutex
 }
 
 // NewHub returns a new instance of Hub.
-func NewHub(cfg *Config, store store.Store, l *log.Logger) *Hub {
-	return &Hub{
-		rooms: make(map[string]*Room),
+func NewHub(cfg *Config, store store.Store, files blob.Store, l *log.Logger) *Hub {
+	h := &Hub{
+		rooms:    make(map[string]*Room),
+		evicting: make(map[string]bool),
 
 		cfg:   cfg,
 		Store: store,
+		Files: files,
 		log:   l,
 	}
+	if files != nil {
+		go h.watchFiles()
+	}
+	return h
 }
 
-// AddRoom creates a new room in the store, adds it to the hub, and
-// returns the room (which has to be .Run() on a goroutine then).
-func (h *Hub) AddRoom(name string, password []byte) (*Room, error) {
+// AddRoom creates a new room with the given properties in the store, adds it
+// to the hub, and returns the room (which has to be .Run() on a goroutine then).
+// The room's ID and creation time are set by the hub.
+func (h *Hub) AddRoom(r store.Room) (*Room, error) {
+	if err := h.admitRoom(false); err != nil {
+		return nil, err
+	}
+
 	id, err := h.generateRoomID(h.cfg.RoomIDLen, 5)
 	if err != nil {
+		h.releaseRoom()
 		return nil, err
 	}
 
 	// Add the room to DB.
-	if err := h.Store.AddRoom(store.Room{ID: id,
-		Name:      name,
-		CreatedAt: time.Now(),
-		Password:  password}, h.cfg.RoomAge); err != nil {
+	r.ID = id
+	r.CreatedAt = time.Now()
+	if err := h.Store.AddRoom(r, h.roomSettings(r).RoomAge); err != nil {
 		h.log.Printf("error creating room in the store: %v", err)
+		h.releaseRoom()
 		return nil, errors.New("error creating room")
 	}
 
 	// Initialize the room.
-	return h.initRoom(id, name, password), nil
+	return h.initRoom(r), nil
 }
 
 // ActivateRoom loads a room from the store into the hub if it's not already active.
@@ -103,8 +233,13 @@ func (h *Hub) ActivateRoom(id string) (*Room, error) {
 		return nil, errors.New("room doesn't exist")
 	}
 
+	// The room is already in the store, so only the active rooms count.
+	if err := h.admitRoom(true); err != nil {
+		return nil, err
+	}
+
 	// Initialize the room.
-	return h.initRoom(r.ID, r.Name, r.Password), nil
+	return h.initRoom(r), nil
 }
 
 // GetRoom retrives an active room from the hub.
@@ -115,22 +250,106 @@ func (h *Hub) GetRoom(id string) *Room {
 	return r
 }
 
-// initRoom initializes a room on the Hub.
-func (h *Hub) initRoom(id, name string, password []byte) *Room {
-	r := NewRoom(id, name, password, h)
+// Notice broadcasts a server notice to an active room, optionally recording
+// it in the room's payload cache for peers who join later.
+func (h *Hub) Notice(roomID, text string, record bool) error {
+	r := h.GetRoom(roomID)
+	if r == nil {
+		return ErrRoomNotFound
+	}
+	r.Broadcast(r.makePayload(payloadMsgNotice{Msg: text}, TypeNotice), record)
+	return nil
+}
+
+// NoticeAll broadcasts a server notice to all active rooms and returns the
+// number of rooms it was sent to.
+func (h *Hub) NoticeAll(text string, record bool) int {
+	h.mut.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
+	}
+	h.mut.RUnlock()
+
+	for _, r := range rooms {
+		r.Broadcast(r.makePayload(payloadMsgNotice{Msg: text}, TypeNotice), record)
+	}
+	return len(rooms)
+}
+
+// PublicRooms returns the active public rooms that aren't locked, optionally
+// only the ones with the given tag, ordered by their number of peers.
+func (h *Hub) PublicRooms(tag string) []PublicRoom {
+	h.mut.RLock()
+	out := make([]PublicRoom, 0)
+	for _, r := range h.rooms {
+		if !r.Public || r.Locked() || (tag != "" && !slices.Contains(r.Tags, tag)) {
+			continue
+		}
+
+		var (
+			n, _ = r.activity()
+			info = r.Info()
+		)
+		out = append(out, PublicRoom{
+			ID:          r.ID,
+			Name:        info.Name,
+			Description: info.Description,
+			Tags:        r.Tags,
+			Peers:       n,
+			CreatedAt:   r.CreatedAt,
+		})
+	}
+	h.mut.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Peers != out[j].Peers {
+			return out[i].Peers > out[j].Peers
+		}
+		return out[i].CreatedAt.After(out[j].CreatedAt)
+	})
+	return out
+}
+
+// initRoom initializes a room on the Hub that's been admitted with
+// admitRoom. If the room has been activated concurrently, the active one
+// is returned.
+func (h *Hub) initRoom(sr store.Room) *Room {
 	h.mut.Lock()
-	h.rooms[id] = r
+	h.pending--
+	if r, ok := h.rooms[sr.ID]; ok {
+		h.mut.Unlock()
+		return r
+	}
+	r := NewRoom(sr, h)
+	h.rooms[r.ID] = r
 	h.mut.Unlock()
+
 	go r.run()
 	return r
 }
 
-// removeRoom removes a room from the hub and the store.
+// releaseRoom releases a room that's been admitted with admitRoom but
+// won't be added to the hub.
+func (h *Hub) releaseRoom() {
+	h.mut.Lock()
+	h.pending--
+	h.mut.Unlock()
+}
+
+// removeRoom removes a room and its files from the hub and the store.
 func (h *Hub) removeRoom(id string) error {
 	h.mut.Lock()
 	delete(h.rooms, id)
+	delete(h.evicting, id)
 	h.mut.Unlock()
 
+	if h.Files != nil {
+		if err := h.Files.RemoveRoom(id); err != nil {
+			h.log.Printf("error removing room files: %v", err)
+		}
+	}
+
 	err := h.Store.RemoveRoom(id)
 	if err != nil {
 		h.log.Printf("error removing room from store: %v", err)
@@ -139,6 +358,72 @@ func (h *Hub) removeRoom(id string) error {
 	return nil
 }
 
+// admitRoom checks whether one more room can be activated without exceeding
+// app.max_rooms and reserves a place for it, which has to be taken with
+// initRoom or given up with releaseRoom. Rooms in the store are counted too,
+// unless the room being activated is already stored. When the limit is hit
+// and the evict_idle policy is set, the least recently active room without
+// peers is disposed of, and the check is repeated once it's been removed.
+func (h *Hub) admitRoom(stored bool) error {
+	for {
+		var c int
+		if h.cfg.MaxRooms > 0 && !stored {
+			n, err := h.Store.CountRooms()
+			if err != nil {
+				h.log.Printf("error counting rooms in the store: %v", err)
+				return errors.New("error checking room count")
+			}
+			c = n
+		}
+
+		h.mut.Lock()
+		n := max(len(h.rooms), c) + h.pending
+		if h.cfg.MaxRooms <= 0 || n < h.cfg.MaxRooms {
+			h.pending++
+			h.mut.Unlock()
+			return nil
+		}
+
+		if h.cfg.RoomLimitPolicy != RoomLimitEvictIdle {
+			h.mut.Unlock()
+			return ErrRoomLimit
+		}
+
+		r := h.idlestRoom()
+		if r == nil {
+			h.mut.Unlock()
+			return ErrRoomLimit
+		}
+		h.evicting[r.ID] = true
+		h.mut.Unlock()
+
+		h.log.Printf("room limit reached. evicting idle room %s", r.ID)
+		r.Dispose()
+		<-r.done
+	}
+}
+
+// idlestRoom returns the active room with no connected peers that has been
+// inactive for the longest time and isn't already being evicted. h.mut has
+// to be held by the caller.
+func (h *Hub) idlestRoom() *Room {
+	var (
+		out  *Room
+		last time.Time
+	)
+	for _, r := range h.rooms {
+		n, t := r.activity()
+		if n > 0 || h.evicting[r.ID] {
+			continue
+		}
+		if out == nil || t.Before(last) {
+			out = r
+			last = t
+		}
+	}
+	return out
+}
+
 // generateRoomID generates a random room ID while checking the store for
 // uniqueness up to numTries times.
 func (h *Hub) generateRoomID(length, numTries int) (string, error) {
@@ -163,6 +448,21 @@ func (h *Hub) generateRoomID(length, numTries int) (string, error) {
 	return "", errors.New("unable to generate unique room ID")
 }
 
+// authorize checks whether a peer with the given role is permitted to send
+// the given message type.
+func authorize(role, typ string) bool {
+	roles, ok := privileges[typ]
+	if !ok {
+		return true
+	}
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 // GenerateGUID generates a cryptographically random, alphanumeric string of length n.
 func GenerateGUID(n int) (string, error) {
 	const dictionary = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
@@ -0,0 +1,122 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Limits on the name, topic, and description of a room.
+const (
+	minRoomNameLen  = 3
+	maxRoomNameLen  = 100
+	maxRoomTopicLen = 200
+	maxRoomDescLen  = 300
+)
+
+// RoomInfo represents the name, topic, and description of a room, which its
+// owner or moderators can change.
+type RoomInfo struct {
+	Name        string `json:"name"`
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+}
+
+// RoomUpdate represents a change of a room's info. Fields that are nil are
+// left unchanged.
+type RoomUpdate struct {
+	Name        *string `json:"name"`
+	Topic       *string `json:"topic"`
+	Description *string `json:"description"`
+}
+
+// payloadMsgRoomUpdate is a room's updated info and the peer who updated it.
+type payloadMsgRoomUpdate struct {
+	PeerID     string `json:"peer_id"`
+	PeerHandle string `json:"peer_handle"`
+	RoomInfo
+}
+
+// Validate checks the lengths of a room's name, topic, and description.
+// The name is optional.
+func (i RoomInfo) Validate() error {
+	if i.Name != "" && (len(i.Name) < minRoomNameLen || len(i.Name) > maxRoomNameLen) {
+		return fmt.Errorf("invalid room name (%d - %d chars)", minRoomNameLen, maxRoomNameLen)
+	}
+	if len(i.Topic) > maxRoomTopicLen {
+		return fmt.Errorf("invalid topic (up to %d chars)", maxRoomTopicLen)
+	}
+	if len(i.Description) > maxRoomDescLen {
+		return fmt.Errorf("invalid description (up to %d chars)", maxRoomDescLen)
+	}
+	return nil
+}
+
+// apply returns the given info with the update applied.
+func (u RoomUpdate) apply(i RoomInfo) RoomInfo {
+	if u.Name != nil {
+		i.Name = strings.TrimSpace(*u.Name)
+	}
+	if u.Topic != nil {
+		i.Topic = strings.TrimSpace(*u.Topic)
+	}
+	if u.Description != nil {
+		i.Description = strings.TrimSpace(*u.Description)
+	}
+	return i
+}
+
+// Info returns the room's name, topic, and description.
+func (r *Room) Info() RoomInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.info
+}
+
+// Name returns the room's name.
+func (r *Room) Name() string {
+	return r.Info().Name
+}
+
+// Update changes the room's info on behalf of the peer with the given
+// session from outside the room's event loop. The session's privileges
+// have to be checked by the caller.
+func (r *Room) Update(s store.Sess, u RoomUpdate) error {
+	if r.closed() {
+		return ErrRoomNotFound
+	}
+
+	b, err := r.updateInfo(s.PeerID, s.Handle, u)
+	if err != nil {
+		return err
+	}
+	r.Broadcast(b, true)
+	return nil
+}
+
+// updateInfo applies an update to the room's info, persists it in the store,
+// and returns the payload to notify the room with.
+func (r *Room) updateInfo(peerID, handle string, u RoomUpdate) ([]byte, error) {
+	if u.Name == nil && u.Topic == nil && u.Description == nil {
+		return nil, errors.New("nothing to update")
+	}
+
+	r.mu.Lock()
+	info := u.apply(r.info)
+	if err := info.Validate(); err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	r.info = info
+	r.mu.Unlock()
+
+	r.saveRoom()
+	r.hub.log.Printf("%s@%s: updated %s", handle, peerID, r.ID)
+	return r.makePayload(payloadMsgRoomUpdate{
+		PeerID:     peerID,
+		PeerHandle: handle,
+		RoomInfo:   info,
+	}, TypeRoomUpdate), nil
+}
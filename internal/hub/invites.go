@@ -0,0 +1,174 @@
+package hub
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+const (
+	// Key in the store under which the key that signs invites is kept.
+	inviteKeyName = "invitekey"
+
+	// Maximum number of unexpired invites to a room.
+	maxInvites = 50
+
+	// Limits on the uses and the expiry of an invite.
+	maxInviteUses = 1000
+	maxInviteTTL  = time.Hour * 24 * 7
+)
+
+// Invite represents an invite to a room along with its signed token.
+type Invite struct {
+	store.Invite
+	Token string `json:"token"`
+}
+
+// CreateInvite mints an invite to a room that can be used maxUses times
+// until it expires after ttl.
+func (h *Hub) CreateInvite(roomID string, maxUses int, ttl time.Duration) (Invite, error) {
+	if maxUses < 1 || maxUses > maxInviteUses {
+		return Invite{}, errors.New("invalid number of uses")
+	}
+	if ttl <= 0 || ttl > maxInviteTTL {
+		return Invite{}, errors.New("invalid invite expiry")
+	}
+
+	invs, err := h.Store.GetInvites(roomID)
+	if err != nil {
+		h.log.Printf("error getting invites: %v", err)
+		return Invite{}, errors.New("error getting invites")
+	}
+	if len(invs) >= maxInvites {
+		return Invite{}, errors.New("too many invites. Revoke some first")
+	}
+
+	id, err := GenerateGUID(16)
+	if err != nil {
+		h.log.Printf("error generating invite ID: %v", err)
+		return Invite{}, errors.New("error generating invite ID")
+	}
+
+	now := time.Now()
+	inv := store.Invite{
+		ID:        id,
+		MaxUses:   maxUses,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := h.Store.AddInvite(roomID, inv); err != nil {
+		h.log.Printf("error creating invite: %v", err)
+		return Invite{}, errors.New("error creating invite")
+	}
+
+	return h.signInvite(roomID, inv)
+}
+
+// Invites returns the unexpired invites to a room.
+func (h *Hub) Invites(roomID string) ([]Invite, error) {
+	invs, err := h.Store.GetInvites(roomID)
+	if err != nil {
+		h.log.Printf("error getting invites: %v", err)
+		return nil, errors.New("error getting invites")
+	}
+
+	out := make([]Invite, 0, len(invs))
+	for _, inv := range invs {
+		i, err := h.signInvite(roomID, inv)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, i)
+	}
+	return out, nil
+}
+
+// RevokeInvite deletes an invite to a room.
+func (h *Hub) RevokeInvite(roomID, id string) error {
+	if err := h.Store.RemoveInvite(roomID, id); err != nil {
+		if errors.Is(err, store.ErrInviteNotFound) {
+			return err
+		}
+		h.log.Printf("error removing invite: %v", err)
+		return errors.New("error removing invite")
+	}
+	return nil
+}
+
+// UseInvite verifies an invite token to a room and counts a use of the
+// invite. It returns store.ErrInviteNotFound if the token is invalid or if
+// the invite has expired or been used up.
+func (h *Hub) UseInvite(roomID, token string) error {
+	id, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return store.ErrInviteNotFound
+	}
+
+	key, err := h.inviteKey()
+	if err != nil {
+		return errors.New("error verifying invite")
+	}
+	if !hmac.Equal([]byte(sig), []byte(makeInviteSig(key, roomID, id))) {
+		return store.ErrInviteNotFound
+	}
+
+	if _, err := h.Store.UseInvite(roomID, id); err != nil {
+		if errors.Is(err, store.ErrInviteNotFound) || errors.Is(err, store.ErrRoomNotFound) {
+			return store.ErrInviteNotFound
+		}
+		h.log.Printf("error using invite: %v", err)
+		return errors.New("error using invite")
+	}
+	return nil
+}
+
+// signInvite attaches the signed token to an invite. The token is the
+// invite's ID and its signature, which binds it to the room.
+func (h *Hub) signInvite(roomID string, inv store.Invite) (Invite, error) {
+	key, err := h.inviteKey()
+	if err != nil {
+		return Invite{}, errors.New("error signing invite")
+	}
+	return Invite{Invite: inv, Token: inv.ID + "." + makeInviteSig(key, roomID, inv.ID)}, nil
+}
+
+// inviteKey returns the key that signs invites. It's generated and saved
+// in the store the first time it's needed so that tokens survive restarts.
+func (h *Hub) inviteKey() ([]byte, error) {
+	h.keyMut.Lock()
+	defer h.keyMut.Unlock()
+
+	if h.invKey != nil {
+		return h.invKey, nil
+	}
+
+	if k, err := h.Store.Get(inviteKeyName); err == nil && len(k) > 0 {
+		h.invKey = k
+		return k, nil
+	}
+
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		h.log.Printf("error generating invite key: %v", err)
+		return nil, err
+	}
+	if err := h.Store.Set(inviteKeyName, k); err != nil {
+		h.log.Printf("error saving invite key: %v", err)
+		return nil, err
+	}
+	h.invKey = k
+	return k, nil
+}
+
+// makeInviteSig returns the signature of an invite to a room.
+func makeInviteSig(key []byte, roomID, id string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(roomID + "." + id))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
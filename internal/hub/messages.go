@@ -0,0 +1,475 @@
+package hub
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/knadh/niltalk/store"
+)
+
+const (
+	// Maximum length of a reaction (eg: an emoji sequence) in runes.
+	maxReactionLen = 16
+
+	// Maximum number of distinct reactions on a message.
+	maxReactions = 20
+
+	// Length of the snippet of a message that's been replied to in runes.
+	replySnippetLen = 100
+
+	// Interval at which changes in the peers' read state are broadcast.
+	readsInterval = time.Second * 2
+
+	// Interval at which expired messages are removed.
+	expireInterval = time.Second
+
+	// Version of the envelope of encrypted messages, the size of its nonce,
+	// and the size of the AES-GCM authentication tag in its ciphertext.
+	envelopeVersion  = 1
+	envelopeNonceLen = 12
+	envelopeTagLen   = 16
+
+	// Room for the JSON around an encrypted message, its nonce, and the IDs
+	// and TTL that come along with it, in bytes.
+	envelopeOverhead = 512
+)
+
+// cachedPayload is a payload recorded in a room's cache. Chat messages are
+// also kept decoded so that they can be altered after they've been sent, and
+// shared files keep their ID so that they can be removed when they expire.
+type cachedPayload struct {
+	data      []byte
+	msg       *payloadMsgChat
+	fileID    string
+	seq       uint64
+	timestamp time.Time
+}
+
+// storedPayload is a cached payload as it's persisted in the store's history.
+// The peers who've reacted to chat messages, which aren't sent out, are
+// kept along.
+type storedPayload struct {
+	Data     json.RawMessage            `json:"data"`
+	Reactors map[string]map[string]bool `json:"reactors,omitempty"`
+}
+
+// expiry is the time at which a message or a shared file with a TTL expires.
+type expiry struct {
+	at   time.Time
+	id   string
+	file bool
+}
+
+// expiryQueue is a min-heap of message expiries. Expiries are tracked apart
+// from the payload cache so that messages that roll out of the cache (or
+// aren't cached at all) still expire.
+type expiryQueue []expiry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x any)        { *q = append(*q, x.(expiry)) }
+func (q *expiryQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// encode encodes a cached chat message into its payload.
+func (c *cachedPayload) encode() {
+	c.data, _ = json.Marshal(payloadMsgWrap{
+		Type:      TypeMessage,
+		Timestamp: c.timestamp,
+		Seq:       c.seq,
+		Data:      c.msg,
+	})
+}
+
+// sendMessage assigns an ID to a peer's chat message, records it, and
+// broadcasts it to the room. If the message is a reply to another message,
+// a snippet of that message is attached, unless that message expires, as the
+// snippet would outlive it. The message expires after the given ttl or the
+// room's default expiry, whichever is shorter.
+func (r *Room) sendMessage(from *Peer, msg string, env *payloadMsgEnvelope, replyTo string, ttl time.Duration) {
+	var reply *payloadMsgReply
+	if replyTo != "" {
+		n := r.findMessage(replyTo)
+		if n < 0 {
+			from.sendError("the message being replied to was not found")
+			return
+		}
+
+		m := r.payloadCache[n].msg
+		reply = &payloadMsgReply{
+			PeerID:     m.PeerID,
+			PeerHandle: m.PeerHandle,
+		}
+		if m.ExpiresAt == nil {
+			reply.Snippet = makeSnippet(m.Msg, replySnippetLen)
+		}
+	}
+
+	if r.MessageTTL > 0 && (ttl == 0 || ttl > r.MessageTTL) {
+		ttl = r.MessageTTL
+	}
+
+	id, err := GenerateGUID(16)
+	if err != nil {
+		r.hub.log.Printf("error generating message ID: %v", err)
+		from.sendError("error sending message")
+		return
+	}
+
+	var (
+		now = time.Now()
+		m   = &payloadMsgChat{
+			ID:         id,
+			PeerID:     from.ID,
+			PeerHandle: from.Handle,
+			Msg:        msg,
+			Envelope:   env,
+			ReplyTo:    replyTo,
+			Reply:      reply,
+		}
+	)
+	if ttl > 0 {
+		t := now.Add(ttl)
+		m.ExpiresAt = &t
+		heap.Push(&r.expiries, expiry{at: t, id: id})
+	}
+
+	c := r.recordPayload(cachedPayload{msg: m, timestamp: now})
+	r.broadcast(c.data, false)
+}
+
+// editMessage replaces the text of a cached message on behalf of its author
+// or a privileged peer, and broadcasts the change to the room. Changes to
+// messages are recorded so that peers resuming their connections get them.
+func (r *Room) editMessage(from *Peer, id, msg string, env *payloadMsgEnvelope) {
+	n := r.findMessage(id)
+	if n < 0 {
+		from.sendError("message not found")
+		return
+	}
+
+	c := &r.payloadCache[n]
+	if !canAlterMessage(from, c.msg) {
+		from.sendError("you can't edit this message")
+		return
+	}
+
+	c.msg.Msg = msg
+	c.msg.Envelope = env
+	c.msg.Edited = true
+	c.encode()
+	r.updateHistory(*c)
+
+	r.broadcast(r.makePayload(payloadMsgUpdate{ID: id, Msg: msg, Envelope: env}, TypeMessageEdit), true)
+}
+
+// deleteMessage removes a cached message on behalf of its author or a
+// privileged peer, and broadcasts the deletion to the room.
+func (r *Room) deleteMessage(from *Peer, id string) {
+	n := r.findMessage(id)
+	if n < 0 {
+		from.sendError("message not found")
+		return
+	}
+
+	if !canAlterMessage(from, r.payloadCache[n].msg) {
+		from.sendError("you can't delete this message")
+		return
+	}
+	r.removeMessage(n)
+
+	// A deleted message doesn't expire anymore.
+	for i, e := range r.expiries {
+		if e.id == id {
+			heap.Remove(&r.expiries, i)
+			break
+		}
+	}
+
+	r.broadcast(r.makePayload(payloadMsgUpdate{ID: id}, TypeMessageDelete), true)
+}
+
+// expireMessages removes the messages whose expiry has passed from the
+// payload cache, if they're still there, and tells the room to erase them.
+// Expired files are deleted from the blob store too.
+func (r *Room) expireMessages() {
+	now := time.Now()
+	for len(r.expiries) > 0 && !now.Before(r.expiries[0].at) {
+		e := heap.Pop(&r.expiries).(expiry)
+		if e.file {
+			r.removeFile(e.id)
+		} else if n := r.findMessage(e.id); n >= 0 {
+			r.removeMessage(n)
+		}
+		r.broadcast(r.makePayload(payloadMsgUpdate{ID: e.id}, TypeMessageExpire), true)
+	}
+}
+
+// removeMessage removes the message or file at the given index from the
+// payload cache and the history.
+func (r *Room) removeMessage(n int) {
+	if r.hub.cfg.PersistHistory {
+		if err := r.hub.Store.RemoveHistory(r.ID, r.payloadCache[n].seq); err != nil {
+			r.hub.log.Printf("error removing message from history: %v", err)
+		}
+	}
+	r.payloadCache = append(r.payloadCache[:n], r.payloadCache[n+1:]...)
+}
+
+// reactMessage toggles a peer's reaction on a cached message and broadcasts
+// the message's updated reaction counts to the room.
+func (r *Room) reactMessage(from *Peer, id, reaction string) {
+	if reaction == "" || utf8.RuneCountInString(reaction) > maxReactionLen {
+		from.sendError("invalid reaction")
+		return
+	}
+
+	n := r.findMessage(id)
+	if n < 0 {
+		from.sendError("message not found")
+		return
+	}
+
+	c := &r.payloadCache[n]
+	m := c.msg
+	if m.reactors == nil {
+		m.reactors = make(map[string]map[string]bool)
+		m.Reactions = make(map[string]int)
+	}
+
+	peers, ok := m.reactors[reaction]
+	if !ok {
+		if len(m.reactors) >= maxReactions {
+			from.sendError("too many reactions on this message")
+			return
+		}
+		peers = make(map[string]bool)
+		m.reactors[reaction] = peers
+	}
+
+	// Toggle the peer's reaction.
+	if peers[from.ID] {
+		delete(peers, from.ID)
+	} else {
+		peers[from.ID] = true
+	}
+
+	if len(peers) == 0 {
+		delete(m.reactors, reaction)
+		delete(m.Reactions, reaction)
+	} else {
+		m.Reactions[reaction] = len(peers)
+	}
+	c.encode()
+	r.updateHistory(*c)
+
+	r.broadcast(r.makePayload(payloadMsgReact{ID: id, Reactions: m.Reactions}, TypeMessageReact), true)
+}
+
+// markRead records the last message seen by a peer. The change is broadcast
+// to the room on the next flushReads. Messages older than the one the peer
+// has already seen are ignored.
+func (r *Room) markRead(from *Peer, id string) {
+	n := r.findMessage(id)
+	if n < 0 {
+		return
+	}
+	if cur, ok := r.reads[from.ID]; ok && r.findMessage(cur) >= n {
+		return
+	}
+
+	r.reads[from.ID] = id
+	r.pendingReads[from.ID] = true
+}
+
+// flushReads broadcasts the read state of peers that have changed since the
+// last flush.
+func (r *Room) flushReads() {
+	if len(r.pendingReads) == 0 {
+		return
+	}
+
+	reads := make(map[string]string, len(r.pendingReads))
+	for id := range r.pendingReads {
+		reads[id] = r.reads[id]
+		delete(r.pendingReads, id)
+	}
+	r.broadcast(r.makeReadsPayload(reads), false)
+}
+
+// makeReadsPayload prepares a message payload with the given read state
+// (peer ID => message ID).
+func (r *Room) makeReadsPayload(reads map[string]string) []byte {
+	out := make([]payloadMsgRead, 0, len(reads))
+	for peerID, id := range reads {
+		out = append(out, payloadMsgRead{PeerID: peerID, ID: id})
+	}
+	return r.makePayload(out, TypeMessageRead)
+}
+
+// loadHistory loads the room's persisted history into the payload cache and
+// resumes the room's sequence from it.
+func (r *Room) loadHistory() {
+	hist, err := r.hub.Store.GetHistory(r.ID, 0)
+	if err != nil {
+		r.hub.log.Printf("error loading history of %s: %v", r.ID, err)
+		return
+	}
+
+	for _, h := range hist {
+		var s storedPayload
+		if err := json.Unmarshal(h.Data, &s); err != nil {
+			r.hub.log.Printf("error decoding history of %s: %v", r.ID, err)
+			continue
+		}
+
+		// Chat messages are decoded so that they can be altered, and files
+		// so that they expire.
+		var (
+			c = cachedPayload{data: s.Data, seq: h.Seq}
+			w struct {
+				Type      string          `json:"type"`
+				Timestamp time.Time       `json:"timestamp"`
+				Data      json.RawMessage `json:"data"`
+			}
+		)
+		if err := json.Unmarshal(s.Data, &w); err == nil {
+			switch w.Type {
+			case TypeMessage:
+				var m payloadMsgChat
+				if err := json.Unmarshal(w.Data, &m); err == nil {
+					m.reactors = s.Reactors
+					c.msg = &m
+					c.timestamp = w.Timestamp
+					if m.ExpiresAt != nil {
+						heap.Push(&r.expiries, expiry{at: *m.ExpiresAt, id: m.ID})
+					}
+				}
+			case TypeFile:
+				var m payloadMsgFile
+				if err := json.Unmarshal(w.Data, &m); err == nil {
+					c.fileID = m.ID
+					if m.ExpiresAt != nil {
+						heap.Push(&r.expiries, expiry{at: *m.ExpiresAt, id: m.ID, file: true})
+					}
+				}
+			}
+		}
+		r.payloadCache = append(r.payloadCache, c)
+	}
+
+	// The cache may have been made smaller since the history was stored.
+	if n := len(r.payloadCache) - r.settings.MaxCachedMessages; n > 0 {
+		r.payloadCache = r.payloadCache[n:]
+	}
+
+	if n := len(r.payloadCache); n > 0 {
+		r.seq = r.payloadCache[n-1].seq
+		r.truncatedSeq = r.payloadCache[0].seq - 1
+	}
+}
+
+// appendHistory persists a recorded payload in the room's history and trims
+// the history to the size of the payload cache.
+func (r *Room) appendHistory(c cachedPayload) {
+	if !r.hub.cfg.PersistHistory {
+		return
+	}
+
+	if err := r.hub.Store.AppendHistory(r.ID, encodeHistory(c)); err != nil {
+		r.hub.log.Printf("error appending to history: %v", err)
+		return
+	}
+	if err := r.hub.Store.TrimHistory(r.ID, r.settings.MaxCachedMessages); err != nil {
+		r.hub.log.Printf("error trimming history: %v", err)
+	}
+}
+
+// updateHistory persists an altered payload in the room's history.
+func (r *Room) updateHistory(c cachedPayload) {
+	if !r.hub.cfg.PersistHistory {
+		return
+	}
+
+	if err := r.hub.Store.UpdateHistory(r.ID, encodeHistory(c)); err != nil {
+		r.hub.log.Printf("error updating history: %v", err)
+	}
+}
+
+// encodeHistory encodes a cached payload to be persisted in the history.
+func encodeHistory(c cachedPayload) store.Payload {
+	s := storedPayload{Data: c.data}
+	if c.msg != nil {
+		s.Reactors = c.msg.reactors
+	}
+	b, _ := json.Marshal(s)
+	return store.Payload{Seq: c.seq, Data: b}
+}
+
+// findMessage returns the index of the chat message with the given ID in the
+// payload cache or -1 if it's not there.
+func (r *Room) findMessage(id string) int {
+	for n, c := range r.payloadCache {
+		if c.msg != nil && c.msg.ID == id {
+			return n
+		}
+	}
+	return -1
+}
+
+// validate checks the version and the sizes of an encrypted message. The
+// ciphertext can't be larger than a plain text message of maxLen bytes. The
+// size of the whole message is bounded by the room's readLimit.
+func (e *payloadMsgEnvelope) validate(maxLen int) error {
+	if e.V != envelopeVersion {
+		return errors.New("unsupported encryption version")
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(e.Nonce)
+	if err != nil || len(nonce) != envelopeNonceLen {
+		return errors.New("invalid nonce")
+	}
+
+	ct, err := base64.StdEncoding.DecodeString(e.Ciphertext)
+	if err != nil || len(ct) <= envelopeTagLen {
+		return errors.New("invalid ciphertext")
+	}
+	if len(ct) > maxLen+envelopeTagLen {
+		return errors.New("message is too long")
+	}
+	return nil
+}
+
+// readLimit returns the size of the largest message that peers in the room
+// can send. In E2E rooms, it's the size of an encrypted message of up to
+// app.max_message_length bytes, whose ciphertext is then checked by validate.
+func (r *Room) readLimit() int64 {
+	n := r.settings.MaxMessageLen
+	if r.E2E {
+		n = base64.StdEncoding.EncodedLen(n+envelopeTagLen) + envelopeOverhead
+	}
+	return int64(n)
+}
+
+// makeSnippet truncates a message to n runes.
+func makeSnippet(msg string, n int) string {
+	if utf8.RuneCountInString(msg) <= n {
+		return msg
+	}
+	return string([]rune(msg)[:n]) + "…"
+}
+
+// canAlterMessage checks whether a peer can edit or delete a message. Only
+// the author and privileged peers can.
+func canAlterMessage(p *Peer, m *payloadMsgChat) bool {
+	return m.PeerID == p.ID || p.Role == RoleOwner || p.Role == RoleModerator
+}
@@ -2,46 +2,100 @@ package hub
 
 import (
 	"encoding/json"
+	"regexp"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/store"
 )
 
+// Minimum interval between a peer's changes of handle.
+const handleChangeInterval = time.Second * 30
+
+// Interval at which the rate limits of peers that have kept to them are
+// forgotten.
+const rateLimitPruneInterval = time.Minute
+
+// reHandle matches valid peer handles.
+var reHandle = regexp.MustCompile(`^[a-zA-Z0-9_\-\.@]{3,30}$`)
+
+// payloadMsgIn represents an incoming message from a peer. Data is decoded
+// further depending on the message type.
+type payloadMsgIn struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
 // Peer represents an individual peer / connection into a room.
 type Peer struct {
-	// Peer's chat handle.
+	// Peer's public ID and chat handle.
 	ID     string
 	Handle string
 
+	// Peer's session ID. This is a secret and must never be sent to
+	// other peers. createdAt is the time at which the session was created.
+	sessID    string
+	createdAt time.Time
+
+	// Peer's role in the room. It's only modified in the room's event loop.
+	Role string
+
+	// Muted peers can't send messages to the room.
+	muted atomic.Bool
+
 	ws *websocket.Conn
+	ip string
 
-	// Channel for outbound messages.
+	// Channel for outbound messages and whether the peer has been
+	// disconnected for not keeping up with it.
 	dataQ chan []byte
+	slow  atomic.Bool
 
-	// Peer's room.
-	room *Room
+	// Peer's room and the sequence number of the last payload the peer
+	// received before its connection dropped, if it's resuming one.
+	room  *Room
+	since uint64
+}
 
-	// Rate limiting.
-	numMessages int
-	lastMessage time.Time
+// rateLimit is a peer's rate limiting token bucket and its violations of the
+// limit. It's kept in the room by the peer's ID so that it's shared by all
+// the peer's connections and survives reconnects.
+type rateLimit struct {
+	tokens     float64
+	lastRefill time.Time
+	violations int
+	mutedUntil time.Time
 }
 
 // newPeer returns a new instance of Peer.
-func newPeer(id, handle string, ws *websocket.Conn, room *Room) *Peer {
-	return &Peer{
-		ID:     id,
-		Handle: handle,
+func newPeer(s store.Sess, ws *websocket.Conn, ip string, room *Room) *Peer {
+	role := s.Role
+	if role == "" {
+		role = RolePeer
+	}
+
+	p := &Peer{
+		ID:     s.PeerID,
+		Handle: s.Handle,
+		sessID: s.ID,
+		Role:   role,
 		ws:     ws,
-		dataQ:  make(chan []byte, 100),
+		ip:     ip,
+		dataQ:  make(chan []byte, room.hub.cfg.MaxMessageQueue),
 		room:   room,
+
+		createdAt: s.CreatedAt,
 	}
+	p.muted.Store(s.Muted)
+	return p
 }
 
 // RunListener is a blocking function that reads incoming messages from a peer's
 // WS connection until its dropped or there's an error. This should be invoked
 // as a goroutine.
 func (p *Peer) RunListener() {
-	p.ws.SetReadLimit(int64(p.room.hub.cfg.MaxMessageLen))
+	p.ws.SetReadLimit(p.room.readLimit())
 	for {
 		_, m, err := p.ws.ReadMessage()
 		if err != nil {
@@ -66,9 +120,68 @@ func (p *Peer) RunWriter() {
 	}
 }
 
-// SendData queues a message to be written to the peer's WS.
+// SendData queues a message to be written to the peer's WS. It never blocks.
+// If the peer's queue is full, app.slow_peer_policy decides whether a message
+// is dropped or the peer is disconnected.
 func (p *Peer) SendData(b []byte) {
-	p.dataQ <- b
+	if p.slow.Load() {
+		return
+	}
+
+	select {
+	case p.dataQ <- b:
+		return
+	default:
+	}
+
+	switch p.room.hub.cfg.SlowPeerPolicy {
+	case SlowPeerDropNewest:
+		return
+
+	case SlowPeerDropOldest:
+		select {
+		case <-p.dataQ:
+		default:
+		}
+		select {
+		case p.dataQ <- b:
+		default:
+		}
+
+	default:
+		if p.slow.Swap(true) {
+			return
+		}
+		// Writing the close frame may block on the stalled connection, so
+		// it's done without holding up the room.
+		p.room.hub.log.Printf("peer %s is too slow. disconnecting from %s", p.ID, p.room.ID)
+		go p.disconnect(TypePeerSlow)
+	}
+}
+
+// session returns the peer's session as stored in the store.
+func (p *Peer) session() store.Sess {
+	return store.Sess{
+		ID:     p.sessID,
+		PeerID: p.ID,
+		Handle: p.Handle,
+		Role:   p.Role,
+		Muted:  p.muted.Load(),
+
+		CreatedAt: p.createdAt,
+	}
+}
+
+// sendError sends an error message to the peer.
+func (p *Peer) sendError(msg string) {
+	p.SendData(p.room.makePayload(msg, TypeError))
+}
+
+// disconnect closes the peer's WS connection giving the reason to the peer.
+func (p *Peer) disconnect(reason string) {
+	p.writeWSControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+	p.ws.Close()
 }
 
 // writeWSData writes the given payload to the peer's WS connection.
@@ -82,51 +195,285 @@ func (p *Peer) writeWSControl(control int, payload []byte) error {
 	return p.ws.WriteControl(control, payload, time.Time{})
 }
 
+// checkRateLimit takes a token from the peer's token bucket, which holds the
+// room's rate_limit_messages tokens and is refilled over its rate_limit_interval.
+// When the bucket is empty, the peer is warned first, then temporarily muted,
+// and kicked out after app.rate_limit_max_violations. It returns false if
+// the message has to be dropped.
+func (p *Peer) checkRateLimit() bool {
+	var (
+		r   = p.room
+		cfg = r.hub.cfg
+		now = time.Now()
+	)
+
+	r.rateLimitsMu.Lock()
+	l := r.rateLimit(p.ID, now)
+
+	// Messages are dropped while the peer is muted.
+	if now.Before(l.mutedUntil) {
+		r.rateLimitsMu.Unlock()
+		return false
+	}
+
+	if l.tokens >= 1 {
+		l.tokens--
+		r.rateLimitsMu.Unlock()
+		return true
+	}
+
+	l.violations++
+	if l.violations > 1 && l.violations < cfg.RateLimitMaxViolations {
+		l.mutedUntil = now.Add(cfg.RateLimitMuteDuration)
+	}
+	violations, mutedUntil := l.violations, l.mutedUntil
+	r.rateLimitsMu.Unlock()
+
+	switch {
+	case violations >= cfg.RateLimitMaxViolations:
+		// All the peer's connections are kicked out.
+		r.hub.Store.RemoveSession(p.sessID, r.ID)
+		r.queuePeerReq(TypePeerRateLimited, p)
+
+	case violations > 1:
+		p.SendData(r.makePayload(payloadMsgWarning{
+			Msg:        "you are sending messages too fast and have been muted for a while",
+			MutedUntil: &mutedUntil,
+		}, TypePeerWarning))
+
+	default:
+		p.SendData(p.room.makePayload(payloadMsgWarning{
+			Msg: "you are sending messages too fast. Slow down",
+		}, TypePeerWarning))
+	}
+	return false
+}
+
+// rateLimit returns a peer's rate limit with its bucket refilled for the time
+// elapsed since the last refill. rateLimitsMu has to be held by the caller.
+func (r *Room) rateLimit(peerID string, now time.Time) *rateLimit {
+	max := float64(r.settings.RateLimitMessages)
+
+	l, ok := r.rateLimits[peerID]
+	if !ok {
+		l = &rateLimit{tokens: max, lastRefill: now}
+		r.rateLimits[peerID] = l
+	}
+
+	l.tokens += now.Sub(l.lastRefill).Seconds() * max / r.settings.RateLimitInterval.Seconds()
+	l.lastRefill = now
+	if l.tokens >= max {
+		// The peer has kept to the limit for a whole interval.
+		l.tokens = max
+		l.violations = 0
+	}
+	return l
+}
+
+// takeToken takes a token from a peer's bucket for an action outside its
+// connections (eg: a file upload). It returns false if the bucket is empty
+// or the peer is muted, without counting a violation.
+func (r *Room) takeToken(peerID string) bool {
+	now := time.Now()
+
+	r.rateLimitsMu.Lock()
+	defer r.rateLimitsMu.Unlock()
+
+	l := r.rateLimit(peerID, now)
+	if now.Before(l.mutedUntil) || l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// pruneRateLimits forgets the rate limits of peers whose buckets have been
+// refilled and who aren't muted, as they're no different from new ones.
+func (r *Room) pruneRateLimits() {
+	var (
+		max = float64(r.settings.RateLimitMessages)
+		now = time.Now()
+	)
+
+	r.rateLimitsMu.Lock()
+	defer r.rateLimitsMu.Unlock()
+	for id, l := range r.rateLimits {
+		tokens := l.tokens + now.Sub(l.lastRefill).Seconds()*max/r.settings.RateLimitInterval.Seconds()
+		if tokens >= max && !now.Before(l.mutedUntil) {
+			delete(r.rateLimits, id)
+		}
+	}
+}
+
+// checkContent checks that the content of a message suits the peer's room.
+// E2E rooms only take encrypted envelopes and other rooms only take plain
+// text. An error is sent to the peer if it doesn't.
+func (p *Peer) checkContent(msg string, env *payloadMsgEnvelope) bool {
+	if !p.room.E2E {
+		if env != nil {
+			p.sendError("this room doesn't accept encrypted messages")
+			return false
+		}
+		return true
+	}
+
+	if env == nil || msg != "" {
+		p.sendError("this room only accepts encrypted messages")
+		return false
+	}
+	if err := env.validate(p.room.settings.MaxMessageLen); err != nil {
+		p.sendError(err.Error())
+		return false
+	}
+	return true
+}
+
 // processMessage processes incoming messages from peers.
 func (p *Peer) processMessage(b []byte) {
-	var m payloadMsgWrap
+	var m payloadMsgIn
 
 	if err := json.Unmarshal(b, &m); err != nil {
 		// TODO: Respond
 		return
 	}
 
+	// All message types count towards the peer's rate limit.
+	if !p.checkRateLimit() {
+		return
+	}
+
 	switch m.Type {
 	// Message to the room.
 	case TypeMessage:
-		// Check rate limits and update counters.
-		now := time.Now()
-		if p.numMessages > 0 {
-			if (p.numMessages%p.room.hub.cfg.RateLimitMessages+1) >= p.room.hub.cfg.RateLimitMessages &&
-				time.Since(p.lastMessage) < p.room.hub.cfg.RateLimitInterval {
-				p.room.hub.Store.RemoveSession(p.ID, p.room.ID)
-				p.writeWSControl(websocket.CloseMessage,
-					websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerRateLimited))
-				p.ws.Close()
-				return
-			}
+		if p.muted.Load() {
+			p.sendError("you are muted in this room")
+			return
+		}
+
+		var d payloadMsgChatIn
+		if err := json.Unmarshal(m.Data, &d); err != nil {
+			p.sendError("invalid message")
+			return
+		}
+		if !p.checkContent(d.Msg, d.Envelope) {
+			return
+		}
+		ttl := time.Duration(d.TTL) * time.Second
+		if ttl < 0 || ttl > MaxMessageTTL {
+			p.sendError("invalid message expiry")
+			return
+		}
+		p.room.markActive()
+		p.room.queueReq(peerReq{reqType: TypeMessage, peer: p, msg: d.Msg, env: d.Envelope, msgID: d.ReplyTo, ttl: ttl})
+
+	// Edit or delete a message. The room checks the peer's privileges.
+	case TypeMessageEdit, TypeMessageDelete:
+		if m.Type == TypeMessageEdit && p.muted.Load() {
+			p.sendError("you are muted in this room")
+			return
+		}
+
+		var d payloadMsgUpdate
+		if err := json.Unmarshal(m.Data, &d); err != nil {
+			p.sendError("invalid message")
+			return
 		}
-		p.lastMessage = now
-		p.numMessages++
+		if m.Type == TypeMessageEdit && !p.checkContent(d.Msg, d.Envelope) {
+			return
+		}
+		p.room.queueReq(peerReq{reqType: m.Type, peer: p, msgID: d.ID, msg: d.Msg, env: d.Envelope})
+
+	// Toggle a reaction on a message.
+	case TypeMessageReact:
+		if p.muted.Load() {
+			p.sendError("you are muted in this room")
+			return
+		}
+
+		var d payloadMsgReact
+		if err := json.Unmarshal(m.Data, &d); err != nil {
+			p.sendError("invalid reaction")
+			return
+		}
+		p.room.queueReq(peerReq{reqType: TypeMessageReact, peer: p, msgID: d.ID, msg: d.Reaction})
 
-		msg, ok := m.Data.(string)
-		if !ok {
-			// TODO: Respond
+	// The last message the peer has seen. These are coalesced by the room.
+	case TypeMessageRead:
+		var d payloadMsgRead
+		if err := json.Unmarshal(m.Data, &d); err != nil || d.ID == "" {
+			return
+		}
+		p.room.queueReq(peerReq{reqType: TypeMessageRead, peer: p, msgID: d.ID})
+
+	// Private message to a peer in the room.
+	case TypeMessageDirect:
+		if p.muted.Load() {
+			p.sendError("you are muted in this room")
+			return
+		}
+
+		var d payloadMsgDirectIn
+		if err := json.Unmarshal(m.Data, &d); err != nil {
+			p.sendError("invalid message")
+			return
+		}
+		if d.PeerID == p.ID {
+			p.sendError("you can't message yourself")
+			return
+		}
+		if !p.checkContent(d.Msg, d.Envelope) {
 			return
 		}
-		p.room.Broadcast(p.room.makeMessagePayload(msg, p), true)
+		p.room.markActive()
+		p.room.queueReq(peerReq{reqType: TypeMessageDirect, peer: p, targetID: d.PeerID, msg: d.Msg, env: d.Envelope})
 
-	// "Typing" status.
+	// "Typing" status. It's broadcast by the room as the peer's handle
+	// can change.
 	case TypeTyping:
-		p.room.Broadcast(p.room.makePeerUpdatePayload(p, TypeTyping), false)
+		if p.muted.Load() {
+			return
+		}
+		p.room.queuePeerReq(TypeTyping, p)
+
+	// Change of handle.
+	case TypeHandle:
+		var d payloadMsgHandle
+		if err := json.Unmarshal(m.Data, &d); err != nil || !reHandle.MatchString(d.Handle) {
+			p.sendError("invalid name. Use 3 to 30 letters, numbers, or _-.@")
+			return
+		}
+		p.room.queueReq(peerReq{reqType: TypeHandle, peer: p, msg: d.Handle})
 
 	// Request for peers list
 	case TypePeerList:
 		p.room.sendPeerList(p)
 
-	// Dipose of a room.
+	// Dipose of a room. The room checks the peer's privileges.
 	case TypeRoomDispose:
-		p.room.Dispose()
+		p.room.queuePeerReq(TypeRoomDispose, p)
+
+	// Lock or unlock the room. The room checks the peer's privileges.
+	case TypeRoomLock, TypeRoomUnlock:
+		p.room.queuePeerReq(m.Type, p)
+
+	// Change the room's name, topic, or description. The room checks the
+	// peer's privileges.
+	case TypeRoomUpdate:
+		var d RoomUpdate
+		if err := json.Unmarshal(m.Data, &d); err != nil {
+			p.sendError("invalid request")
+			return
+		}
+		p.room.queueReq(peerReq{reqType: TypeRoomUpdate, peer: p, update: &d})
+
+	// Actions on other peers. The room checks the peer's privileges.
+	case TypePeerRole, TypePeerKick, TypePeerBan, TypePeerMute, TypePeerUnmute:
+		var d payloadMsgPeerAction
+		if err := json.Unmarshal(m.Data, &d); err != nil {
+			p.sendError("invalid request")
+			return
+		}
+		p.room.queueReq(peerReq{reqType: m.Type, peer: p, targetID: d.PeerID, role: d.Role})
 	default:
 	}
 }
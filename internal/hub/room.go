@@ -2,93 +2,376 @@ package hub
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/store"
 )
 
 type payloadMsgWrap struct {
 	Type      string    `json:"type"`
 	Timestamp time.Time `json:"timestamp"`
+	Seq       uint64    `json:"seq,omitempty"`
 	Data      any       `json:"data"`
 }
 
 type payloadMsgPeer struct {
 	ID     string `json:"id"`
 	Handle string `json:"handle"`
+	Role   string `json:"role"`
+	Muted  bool   `json:"muted,omitempty"`
+}
+
+type payloadMsgPeerInfo struct {
+	payloadMsgPeer
+
+	// Inactivity timeout (seconds) and the deadlines after which the room
+	// is disposed of.
+	IdleTimeout   int        `json:"idle_timeout"`
+	IdleExpiresAt time.Time  `json:"idle_expires_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+
+	// Whether messages in the room are end-to-end encrypted.
+	E2E bool `json:"e2e,omitempty"`
+
+	// Default expiry of the messages in the room (seconds).
+	MessageTTL int `json:"message_ttl,omitempty"`
+
+	// Whether the room is locked to new peers.
+	Locked bool `json:"locked,omitempty"`
+
+	// Limits of the room.
+	MaxPeers      int `json:"max_peers"`
+	MaxMessageLen int `json:"max_message_length"`
+
+	// Name, topic, and description of the room.
+	Room RoomInfo `json:"room"`
 }
 
 type payloadMsgChat struct {
+	ID         string `json:"id"`
 	PeerID     string `json:"peer_id"`
 	PeerHandle string `json:"peer_handle"`
 	Msg        string `json:"message"`
+	Edited     bool   `json:"edited,omitempty"`
+
+	// Time after which the message is removed from the room, if any.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Encrypted message in E2E rooms, where Msg is empty.
+	Envelope *payloadMsgEnvelope `json:"envelope,omitempty"`
+
+	// ID of the message being replied to and a snippet of it.
+	ReplyTo string           `json:"reply_to,omitempty"`
+	Reply   *payloadMsgReply `json:"reply,omitempty"`
+
+	// Number of peers who've reacted to the message with each reaction and
+	// the IDs of those peers.
+	Reactions map[string]int `json:"reactions,omitempty"`
+	reactors  map[string]map[string]bool
+}
+
+// payloadMsgReply is a snippet of a message that's been replied to.
+type payloadMsgReply struct {
+	PeerID     string `json:"peer_id"`
+	PeerHandle string `json:"peer_handle"`
+	Snippet    string `json:"snippet,omitempty"`
+}
+
+// payloadMsgEnvelope is an end-to-end encrypted message. The nonce and the
+// ciphertext are base64 encoded and the server never decrypts them.
+type payloadMsgEnvelope struct {
+	V          int    `json:"v"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// payloadMsgChatIn is a chat message sent by a peer. A plain string is also
+// accepted as the message. TTL is the message's expiry in seconds.
+type payloadMsgChatIn struct {
+	Msg      string              `json:"message"`
+	Envelope *payloadMsgEnvelope `json:"envelope"`
+	ReplyTo  string              `json:"reply_to"`
+	TTL      int                 `json:"ttl"`
+}
+
+// UnmarshalJSON decodes either a plain string or an object into the message.
+func (m *payloadMsgChatIn) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &m.Msg); err == nil {
+		return nil
+	}
+
+	type msg payloadMsgChatIn
+	return json.Unmarshal(b, (*msg)(m))
+}
+
+// payloadMsgUpdate represents an edit or a deletion of a chat message.
+type payloadMsgUpdate struct {
+	ID       string              `json:"id"`
+	Msg      string              `json:"message,omitempty"`
+	Envelope *payloadMsgEnvelope `json:"envelope,omitempty"`
+}
+
+// payloadMsgReact represents a peer's reaction to a message and the updated
+// reaction counts of the message.
+type payloadMsgReact struct {
+	ID        string         `json:"id"`
+	Reaction  string         `json:"reaction,omitempty"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+}
+
+// payloadMsgRead is the ID of the last message that a peer has seen.
+type payloadMsgRead struct {
+	PeerID string `json:"peer_id,omitempty"`
+	ID     string `json:"id"`
+}
+
+// payloadMsgDirect is a private message between two peers.
+type payloadMsgDirect struct {
+	payloadMsgChat
+	ToID     string `json:"to_id"`
+	ToHandle string `json:"to_handle"`
+}
+
+// payloadMsgDirectIn is a private message sent by a peer to another.
+type payloadMsgDirectIn struct {
+	PeerID   string              `json:"peer_id"`
+	Msg      string              `json:"message"`
+	Envelope *payloadMsgEnvelope `json:"envelope"`
+}
+
+// payloadMsgHandle represents a peer's change of handle.
+type payloadMsgHandle struct {
+	PeerID    string `json:"peer_id,omitempty"`
+	OldHandle string `json:"old_handle,omitempty"`
+	Handle    string `json:"handle"`
+}
+
+// payloadMsgNotice is a notice from the server (and not a peer) to a room.
+type payloadMsgNotice struct {
+	Msg string `json:"message"`
+}
+
+// payloadMsgFile is a file shared by a peer in a room.
+type payloadMsgFile struct {
+	ID         string     `json:"id"`
+	PeerID     string     `json:"peer_id"`
+	PeerHandle string     `json:"peer_handle"`
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Size       int64      `json:"size"`
+	URL        string     `json:"url"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// payloadMsgWarning is a warning to a peer that's exceeded the rate limit.
+type payloadMsgWarning struct {
+	Msg        string     `json:"message"`
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+}
+
+// payloadMsgTruncated tells a peer resuming its connection that some of the
+// payloads it's missed since the given sequence number are no longer
+// available.
+type payloadMsgTruncated struct {
+	Since uint64 `json:"since"`
+}
+
+// payloadMsgPeerAction represents an action on a peer, such as a role
+// change or a kick.
+type payloadMsgPeerAction struct {
+	PeerID string `json:"peer_id"`
+	Role   string `json:"role,omitempty"`
 }
 
 // peerReq represents a peer request (join, leave etc.) that's processed
-// by a Room.
+// by a Room. targetID is the ID of the peer that a request acts on and
+// msgID is the ID of the chat message that a request acts on. Files shared
+// over HTTP are queued to the room to be recorded and broadcast. Requests
+// queued by the room itself don't have a peer.
 type peerReq struct {
-	reqType string
-	peer    *Peer
+	reqType  string
+	peer     *Peer
+	targetID string
+	role     string
+	msg      string
+	env      *payloadMsgEnvelope
+	msgID    string
+	ttl      time.Duration
+	update   *RoomUpdate
+	file     *payloadMsgFile
+}
+
+// broadcastReq is a payload queued to be sent to all peers in a room.
+type broadcastReq struct {
+	data   []byte
+	record bool
 }
 
 // Room represents a chat room.
 type Room struct {
-	ID       string
-	Name     string
-	Password []byte
-	hub      *Hub
+	ID        string
+	CreatedAt time.Time
+	E2E       bool
+	hub       *Hub
+
+	// Default expiry of the messages in the room, if any.
+	MessageTTL time.Duration
+
+	// Limits of the room, which override the app's defaults.
+	settings store.RoomSettings
+
+	// Public rooms have no password and are listed in the room directory.
+	Public bool
+	Tags   []string
 
 	// List of connected peers.
 	peers map[*Peer]bool
 
 	// Broadcast channel for messages.
-	broadcastQ chan []byte
+	broadcastQ chan broadcastReq
 
 	// Peer related requests.
 	peerQ chan peerReq
 
 	// Dispose signal.
 	disposeSig chan bool
-	closed     bool
 
-	// Message / payload cache.
-	payloadCache [][]byte
+	// Closed once the room has been disposed of and removed from the hub,
+	// after which broadcasts and requests to the room are dropped.
+	done chan struct{}
+
+	// Message / payload cache. Every recorded payload gets the next sequence
+	// number. truncatedSeq is the last sequence number that's rolled out of
+	// the cache.
+	payloadCache []cachedPayload
+	seq          uint64
+	truncatedSeq uint64
+
+	// Expiries of the messages that have TTLs.
+	expiries expiryQueue
+
+	// IDs of the last messages seen by peers (peer ID => message ID) and
+	// the peers whose read state is yet to be broadcast.
+	reads        map[string]string
+	pendingReads map[string]bool
+
+	// Times at which peers last changed their handles (peer ID => time).
+	handleChanges map[string]time.Time
+
+	// Rate limits of peers by their IDs, which are checked by the peers'
+	// listeners outside the event loop.
+	rateLimits   map[string]*rateLimit
+	rateLimitsMu sync.Mutex
+
+	// Serializes the uploads of files, which happen outside the event loop,
+	// to keep them within the room's quota.
+	filesMu sync.Mutex
+
+	// Serializes the writes of the room's properties to the store so that
+	// the latest ones stick.
+	storeMu sync.Mutex
 
 	timestamp time.Time
+
+	// Activity stats, the lock state, the room's info, and its password hash
+	// that are read outside the room's event loop. lastActive is the time of
+	// the last chat message or the first join.
+	mu         sync.RWMutex
+	numPeers   int
+	joined     bool
+	lastActive time.Time
+	locked     bool
+	lockedAt   time.Time
+	info       RoomInfo
+	password   []byte
 }
 
 // NewRoom returns a new instance of Room.
-func NewRoom(id, name string, password []byte, h *Hub) *Room {
+func NewRoom(sr store.Room, h *Hub) *Room {
 	return &Room{
-		ID:           id,
-		Name:         name,
-		Password:     password,
-		hub:          h,
-		peers:        make(map[*Peer]bool, 100),
-		broadcastQ:   make(chan []byte, 100),
-		peerQ:        make(chan peerReq, 100),
-		disposeSig:   make(chan bool),
-		payloadCache: make([][]byte, 0, h.cfg.MaxCachedMessages),
+		ID:            sr.ID,
+		password:      sr.Password,
+		CreatedAt:     sr.CreatedAt,
+		E2E:           sr.E2E,
+		MessageTTL:    sr.MessageTTL,
+		settings:      h.roomSettings(sr),
+		Public:        sr.Public,
+		Tags:          sr.Tags,
+		hub:           h,
+		peers:         make(map[*Peer]bool, 100),
+		broadcastQ:    make(chan broadcastReq, 100),
+		peerQ:         make(chan peerReq, 100),
+		disposeSig:    make(chan bool, 1),
+		done:          make(chan struct{}),
+		payloadCache:  make([]cachedPayload, 0, h.roomSettings(sr).MaxCachedMessages),
+		reads:         make(map[string]string),
+		pendingReads:  make(map[string]bool),
+		handleChanges: make(map[string]time.Time),
+		rateLimits:    make(map[string]*rateLimit),
+		lastActive:    time.Now(),
+		locked:        sr.Locked,
+		lockedAt:      sr.LockedAt,
+		info: RoomInfo{
+			Name:        sr.Name,
+			Topic:       sr.Topic,
+			Description: sr.Description,
+		},
 	}
 }
 
-// AddPeer adds a new peer to the room given a WS connection from an HTTP
-// handler.
-func (r *Room) AddPeer(id, handle string, ws *websocket.Conn) {
-	r.queuePeerReq(TypePeerJoin, newPeer(id, handle, ws, r))
+// AddPeer adds a new peer to the room given its session and a WS connection
+// from an HTTP handler. ip is the peer's IP that's banned along with it, if
+// IP bans are enabled. A peer resuming a dropped connection passes the
+// sequence number of the last payload it received as since.
+func (r *Room) AddPeer(s store.Sess, ws *websocket.Conn, ip string, since uint64) {
+	// Sessions created by older versions don't have a public peer ID.
+	if s.PeerID == "" {
+		id, err := GenerateGUID(16)
+		if err != nil {
+			r.hub.log.Printf("error generating peer ID: %v", err)
+			ws.Close()
+			return
+		}
+		s.PeerID = id
+		if err := r.hub.Store.UpdateSession(s, r.ID); err != nil {
+			r.hub.log.Printf("error updating session: %v", err)
+		}
+	}
+
+	p := newPeer(s, ws, ip, r)
+	p.since = since
+	r.queuePeerReq(TypePeerJoin, p)
 }
 
 // Dispose signals the room to notify all connected peer messages, and dispose
-// of itself.
+// of itself. It doesn't block if a disposal is already pending.
 func (r *Room) Dispose() {
-	r.disposeSig <- true
+	select {
+	case r.disposeSig <- true:
+	default:
+	}
 }
 
-// Broadcast broadcasts a message to all connected peers.
+// Broadcast queues a message to be broadcast to all connected peers and
+// optionally recorded in the payload cache.
 func (r *Room) Broadcast(data []byte, record bool) {
-	r.broadcastQ <- data
-	if record {
-		r.recordMsgPayload(data)
+	select {
+	case r.broadcastQ <- broadcastReq{data: data, record: record}:
+	case <-r.done:
+	}
+}
+
+// closed returns whether the room has been disposed of.
+func (r *Room) closed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -96,6 +379,35 @@ func (r *Room) Broadcast(data []byte, record bool) {
 // handles peer connection events and message broadcasts. This should be invoked
 // as a goroutine.
 func (r *Room) run() {
+	if r.hub.cfg.PersistHistory && r.settings.MaxCachedMessages > 0 {
+		r.loadHistory()
+	}
+
+	// Inactivity timer. It's checked against the latest deadline when it
+	// fires as chat messages keep pushing the deadline forward.
+	idle := time.NewTimer(time.Until(r.idleDeadline()))
+	defer idle.Stop()
+
+	// Hard limit on the room's lifetime counted from its creation.
+	var maxAge <-chan time.Time
+	if r.hub.cfg.RoomMaxAge > 0 {
+		t := time.NewTimer(time.Until(r.CreatedAt.Add(r.hub.cfg.RoomMaxAge)))
+		defer t.Stop()
+		maxAge = t.C
+	}
+
+	// Read receipts are collected and broadcast periodically.
+	reads := time.NewTicker(readsInterval)
+	defer reads.Stop()
+
+	// Messages that have expired are swept periodically.
+	expire := time.NewTicker(expireInterval)
+	defer expire.Stop()
+
+	// Rate limits that have lapsed are forgotten periodically.
+	limits := time.NewTicker(rateLimitPruneInterval)
+	defer limits.Stop()
+
 loop:
 	for {
 		select {
@@ -105,69 +417,178 @@ loop:
 			break loop
 
 		// Incoming peer request.
-		case req, ok := <-r.peerQ:
-			if !ok {
-				break loop
+		case req := <-r.peerQ:
+			// Requests without a peer are queued by the room itself.
+			if req.peer != nil {
+				// Ignore requests from peers that have already left.
+				if req.reqType != TypePeerJoin && !r.peers[req.peer] {
+					continue
+				}
+
+				if !authorize(req.peer.Role, req.reqType) {
+					req.peer.sendError("you are not permitted to do that")
+					continue
+				}
 			}
 
 			switch req.reqType {
 			// A new peer has joined.
 			case TypePeerJoin:
 				// Room's capacity is exchausted. Kick the peer out.
-				if len(r.peers) >= r.hub.cfg.MaxPeersPerRoom {
-					r.hub.Store.RemoveSession(req.peer.ID, r.ID)
-					req.peer.writeWSControl(websocket.CloseMessage,
-						websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeRoomFull))
-					req.peer.ws.Close()
+				if len(r.peers) >= r.settings.MaxPeers {
+					r.hub.Store.RemoveSession(req.peer.sessID, r.ID)
+					req.peer.disconnect(TypeRoomFull)
+					continue
+				}
+
+				// Only the peers who had sessions before the room was locked
+				// can join a locked room.
+				if locked, t := r.lockState(); locked && req.peer.createdAt.After(t) {
+					r.hub.Store.RemoveSession(req.peer.sessID, r.ID)
+					req.peer.disconnect(TypeRoomLocked)
 					continue
 				}
 
 				r.peers[req.peer] = true
+				r.updatePeerCount()
 				go req.peer.RunListener()
 				go req.peer.RunWriter()
 
+				// The inactivity timeout is counted from the first login.
+				if r.markJoined() {
+					idle.Reset(time.Until(r.idleDeadline()))
+				}
+
 				// Send the peer its info.
-				req.peer.SendData(r.makePeerUpdatePayload(req.peer, TypePeerInfo))
+				req.peer.SendData(r.makePeerInfoPayload(req.peer))
+
+				// Send the peer last N message or the ones it's missed.
+				r.sendHistory(req.peer)
 
-				// Send the peer last N message.
-				if r.hub.cfg.MaxCachedMessages > 0 {
-					for _, b := range r.payloadCache {
-						req.peer.SendData(b)
-					}
+				// Send the peer the room's read state.
+				if len(r.reads) > 0 {
+					req.peer.SendData(r.makeReadsPayload(r.reads))
 				}
 
 				// Notify all peers of the new addition.
-				r.Broadcast(r.makePeerUpdatePayload(req.peer, TypePeerJoin), true)
+				r.broadcast(r.makePeerUpdatePayload(req.peer, TypePeerJoin), true)
 				r.hub.log.Printf("%s@%s joined %s", req.peer.Handle, req.peer.ID, r.ID)
 
 			// A peer has left.
 			case TypePeerLeave:
 				r.removePeer(req.peer)
-				r.Broadcast(r.makePeerUpdatePayload(req.peer, TypePeerLeave), true)
+				r.updatePeerCount()
+				r.broadcast(r.makePeerUpdatePayload(req.peer, TypePeerLeave), true)
 				r.hub.log.Printf("%s@%s left %s", req.peer.Handle, req.peer.ID, r.ID)
 
+			// The sessions of all peers but the ones with the given session
+			// ID have been revoked.
+			case TypePeerRevoked:
+				if req.peer == nil {
+					r.disconnectPeers(req.targetID)
+				}
+
+			// A peer has exceeded the rate limit too many times. All its
+			// connections are kicked out.
+			case TypePeerRateLimited:
+				for _, p := range r.findPeers(req.peer.ID) {
+					p.disconnect(TypePeerRateLimited)
+				}
+
 			// A peer has requested the room's peer list.
 			case TypePeerList:
 				req.peer.SendData(r.makePeerListPayload())
-			}
 
-		// Fanout broadcast to all peers.
-		case m, ok := <-r.broadcastQ:
-			if !ok {
+			// A privileged peer has disposed of the room.
+			case TypeRoomDispose:
+				r.hub.log.Printf("%s@%s disposed %s", req.peer.Handle, req.peer.ID, r.ID)
+				r.hub.Store.ClearSessions(r.ID)
 				break loop
-			}
-			for p := range r.peers {
-				p.SendData(m)
-			}
 
-			// Extend the room's expiry (once every 30 seconds).
-			if time.Since(r.timestamp) > time.Duration(30)*time.Second {
-				r.timestamp = time.Now()
-				r.extendTTL()
+			// The owner has locked or unlocked the room.
+			case TypeRoomLock, TypeRoomUnlock:
+				r.setLocked(req.peer, req.reqType == TypeRoomLock)
+
+			// The room's name, topic, or description has been changed.
+			case TypeRoomUpdate:
+				b, err := r.updateInfo(req.peer.ID, req.peer.Handle, *req.update)
+				if err != nil {
+					req.peer.sendError(err.Error())
+					continue
+				}
+				r.broadcast(b, true)
+
+			// A peer is typing.
+			case TypeTyping:
+				r.broadcast(r.makePeerUpdatePayload(req.peer, TypeTyping), false)
+
+			// A peer has changed its handle.
+			case TypeHandle:
+				r.changeHandle(req.peer, req.msg)
+
+			// The owner has changed a peer's role.
+			case TypePeerRole:
+				r.setPeerRole(req.peer, req.targetID, req.role)
+
+			// A peer has sent a message to the room.
+			case TypeMessage:
+				r.sendMessage(req.peer, req.msg, req.env, req.msgID, req.ttl)
+
+			// A peer has edited or deleted a message.
+			case TypeMessageEdit:
+				r.editMessage(req.peer, req.msgID, req.msg, req.env)
+			case TypeMessageDelete:
+				r.deleteMessage(req.peer, req.msgID)
+
+			// A peer has reacted to a message.
+			case TypeMessageReact:
+				r.reactMessage(req.peer, req.msgID, req.msg)
+
+			// A peer has seen a message.
+			case TypeMessageRead:
+				r.markRead(req.peer, req.msgID)
+
+			// A peer has sent a private message to another peer.
+			case TypeMessageDirect:
+				r.sendDirect(req.peer, req.targetID, req.msg, req.env)
+
+			// A peer has shared a file.
+			case TypeFile:
+				r.shareFile(req.file)
+
+			// A privileged peer has acted on another peer.
+			case TypePeerKick, TypePeerBan, TypePeerMute, TypePeerUnmute:
+				r.moderatePeer(req.peer, req.reqType, req.targetID)
 			}
 
+		// Fanout broadcast to all peers.
+		case b := <-r.broadcastQ:
+			r.broadcast(b.data, b.record)
+
+		// Broadcast the read state of peers that have seen new messages.
+		case <-reads.C:
+			r.flushReads()
+
+		// Remove the messages that have expired.
+		case <-expire.C:
+			r.expireMessages()
+
+		// Forget the rate limits of peers that have kept to them.
+		case <-limits.C:
+			r.pruneRateLimits()
+
 		// Kill the room after the inactivity period.
-		case <-time.After(r.hub.cfg.RoomAge):
+		case <-idle.C:
+			if d := time.Until(r.idleDeadline()); d > 0 {
+				idle.Reset(d)
+				continue
+			}
+			r.hub.log.Printf("room %s is inactive", r.ID)
+			break loop
+
+		// Kill the room once it reaches its maximum age.
+		case <-maxAge:
+			r.hub.log.Printf("room %s has reached its maximum age", r.ID)
 			break loop
 		}
 	}
@@ -176,16 +597,87 @@ loop:
 	r.remove()
 }
 
-// extendTTL extends a room's TTL in the store.
+// extendTTL extends a room's TTL in the store, but not beyond its maximum age.
 func (r *Room) extendTTL() {
-	r.hub.Store.ExtendRoomTTL(r.ID, r.hub.cfg.RoomAge)
+	ttl := r.settings.RoomAge
+	if r.hub.cfg.RoomMaxAge > 0 {
+		if d := time.Until(r.CreatedAt.Add(r.hub.cfg.RoomMaxAge)); d < ttl {
+			ttl = d
+		}
+	}
+	r.hub.Store.ExtendRoomTTL(r.ID, ttl)
+}
+
+// updatePeerCount records the number of connected peers.
+func (r *Room) updatePeerCount() {
+	r.mu.Lock()
+	r.numPeers = len(r.peers)
+	r.mu.Unlock()
+}
+
+// markActive marks the room as being active now, pushing its inactivity
+// deadline forward.
+func (r *Room) markActive() {
+	r.mu.Lock()
+	r.lastActive = time.Now()
+	r.mu.Unlock()
+}
+
+// markJoined records the first login into the room, from which point on the
+// inactivity timeout applies. It returns false if a peer had already joined.
+func (r *Room) markJoined() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.joined {
+		return false
+	}
+	r.joined = true
+	r.lastActive = time.Now()
+	return true
+}
+
+// idleDeadline returns the time after which the room is disposed of for
+// inactivity. Until the first login, a room lives for app.room_age.
+func (r *Room) idleDeadline() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !r.joined {
+		return r.lastActive.Add(r.settings.RoomAge)
+	}
+	return r.lastActive.Add(r.hub.cfg.RoomTimeout)
+}
+
+// Settings returns the room's limits.
+func (r *Room) Settings() store.RoomSettings {
+	return r.settings
+}
+
+// Locked returns whether the room is locked to new peers.
+func (r *Room) Locked() bool {
+	locked, _ := r.lockState()
+	return locked
+}
+
+// lockState returns whether the room is locked and the time at which it
+// was locked.
+func (r *Room) lockState() (bool, time.Time) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.locked, r.lockedAt
+}
+
+// activity returns the number of connected peers and the time at which the
+// room was last active.
+func (r *Room) activity() (int, time.Time) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.numPeers, r.lastActive
 }
 
 // remove disposes a room by notifying and disconnecting all peers and
-// removing the room from the store.
+// removing the room from the store. The room's queues are left open as
+// other goroutines may still be sending to them, and are dropped with done.
 func (r *Room) remove() {
-	r.closed = true
-
 	// Close all peer WS connections.
 	for peer := range r.peers {
 		peer.writeWSControl(websocket.CloseMessage,
@@ -193,33 +685,88 @@ func (r *Room) remove() {
 		delete(r.peers, peer)
 	}
 
-	// Close all room channels.
-	close(r.broadcastQ)
-	close(r.peerQ)
 	r.hub.removeRoom(r.ID)
+	close(r.done)
 }
 
-// recordMsgPayload records message payloads (events) sent out. It maintains last
-// N messages to be sent to new users when they join.
-func (r *Room) recordMsgPayload(b []byte) {
-	if r.hub.cfg.MaxCachedMessages == 0 {
-		return
+// broadcast sends a payload to all connected peers from within the room's
+// event loop, optionally recording it in the payload cache.
+func (r *Room) broadcast(b []byte, record bool) {
+	if record {
+		b = r.recordPayload(cachedPayload{data: b}).data
+	}
+
+	for p := range r.peers {
+		p.SendData(b)
+	}
+
+	// Extend the room's expiry (once every 30 seconds).
+	if time.Since(r.timestamp) > time.Duration(30)*time.Second {
+		r.timestamp = time.Now()
+		r.extendTTL()
+	}
+}
+
+// recordPayload assigns the next sequence number to a message payload (event)
+// sent out and records it. It maintains last N messages to be sent to new users
+// when they join. The payload encoded with its sequence number is returned.
+func (r *Room) recordPayload(c cachedPayload) cachedPayload {
+	r.seq++
+	c.seq = r.seq
+	if c.msg != nil {
+		c.encode()
+	} else {
+		c.data = setSeq(c.data, c.seq)
+	}
+
+	if r.settings.MaxCachedMessages == 0 {
+		r.truncatedSeq = c.seq
+		return c
 	}
 
 	n := len(r.payloadCache)
-	if n >= r.hub.cfg.MaxCachedMessages {
+	if n >= r.settings.MaxCachedMessages {
+		r.truncatedSeq = r.payloadCache[0].seq
 		r.payloadCache = r.payloadCache[1:]
 	}
 
-	r.payloadCache = append(r.payloadCache, b)
+	r.payloadCache = append(r.payloadCache, c)
+	r.appendHistory(c)
+	return c
+}
+
+// sendHistory sends the cached payloads to a peer that's joined. A peer that's
+// resuming its connection only gets the payloads after the last one it's seen.
+// If some of those are no longer in the cache, or if the room's sequence has
+// restarted (eg: the room has been reloaded), the peer is told that the
+// history is truncated before it gets the whole cache.
+func (r *Room) sendHistory(p *Peer) {
+	since := p.since
+	if since > 0 && (since < r.truncatedSeq || since > r.seq) {
+		p.SendData(r.makePayload(payloadMsgTruncated{Since: since}, TypeTruncated))
+		if since > r.seq {
+			since = 0
+		}
+	}
+
+	for _, c := range r.payloadCache {
+		if c.seq > since {
+			p.SendData(c.data)
+		}
+	}
 }
 
 // queuePeerReq queues a peer addition / removal request to the room.
 func (r *Room) queuePeerReq(reqType string, p *Peer) {
-	if r.closed {
-		return
+	r.queueReq(peerReq{reqType: reqType, peer: p})
+}
+
+// queueReq queues a peer request to the room.
+func (r *Room) queueReq(req peerReq) {
+	select {
+	case r.peerQ <- req:
+	case <-r.done:
 	}
-	p.room.peerQ <- peerReq{reqType: reqType, peer: p}
 }
 
 // removePeer removes a peer from the room and broadcasts a message to the
@@ -227,18 +774,289 @@ func (r *Room) queuePeerReq(reqType string, p *Peer) {
 func (r *Room) removePeer(p *Peer) {
 	close(p.dataQ)
 	delete(r.peers, p)
+
+	// Forget the peer's read state once all its connections are gone.
+	if len(r.findPeers(p.ID)) == 0 {
+		delete(r.reads, p.ID)
+		delete(r.pendingReads, p.ID)
+	}
+}
+
+// setPeerRole changes the role of a connected peer, persists it in the peer's
+// session, and notifies the room.
+func (r *Room) setPeerRole(from *Peer, targetID, role string) {
+	if role != RoleModerator && role != RolePeer {
+		from.sendError("invalid role")
+		return
+	}
+
+	// A peer may be connected more than once (eg: multiple tabs).
+	var target *Peer
+	for p := range r.peers {
+		if p.ID != targetID {
+			continue
+		}
+		if p.Role == RoleOwner {
+			from.sendError("the owner's role can't be changed")
+			return
+		}
+
+		p.Role = role
+		p.SendData(r.makePeerInfoPayload(p))
+		target = p
+	}
+	if target == nil {
+		from.sendError("peer not found")
+		return
+	}
+
+	if err := r.hub.Store.UpdateSession(target.session(), r.ID); err != nil {
+		r.hub.log.Printf("error updating session: %v", err)
+	}
+	r.broadcast(r.makePayload(payloadMsgPeerAction{PeerID: target.ID, Role: role}, TypePeerRole), false)
+	r.hub.log.Printf("%s@%s made %s@%s %s in %s", from.Handle, from.ID, target.Handle, target.ID, role, r.ID)
+}
+
+// setLocked locks or unlocks the room on behalf of its owner, persists the
+// lock state in the store, and notifies the room.
+func (r *Room) setLocked(from *Peer, locked bool) {
+	r.mu.Lock()
+	if r.locked == locked {
+		r.mu.Unlock()
+		return
+	}
+	r.locked = locked
+	r.lockedAt = time.Time{}
+	if locked {
+		r.lockedAt = time.Now()
+	}
+	r.mu.Unlock()
+	r.saveRoom()
+
+	typ := TypeRoomUnlock
+	if locked {
+		typ = TypeRoomLock
+	}
+	r.broadcast(r.makePeerUpdatePayload(from, typ), true)
+	r.hub.log.Printf("%s@%s: %s %s", from.Handle, from.ID, typ, r.ID)
+}
+
+// PasswordHash returns the bcrypt hash of the room's password. Public rooms
+// don't have one.
+func (r *Room) PasswordHash() []byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.password
+}
+
+// SetPassword changes the room's password hash on behalf of its owner with
+// the given session and persists it. If revoke is set, all the sessions in
+// the room but the owner's are deleted and the other peers are disconnected,
+// which makes them log in again with the new password. The session's
+// privileges have to be checked by the caller.
+func (r *Room) SetPassword(s store.Sess, hash []byte, revoke bool) error {
+	if r.closed() {
+		return ErrRoomNotFound
+	}
+	if r.Public {
+		return errors.New("public rooms don't have passwords")
+	}
+
+	r.mu.Lock()
+	r.password = hash
+	r.mu.Unlock()
+	if err := r.saveRoom(); err != nil {
+		return errors.New("error updating room")
+	}
+
+	if revoke {
+		if err := r.hub.Store.RemoveSessionsExcept(s.ID, r.ID); err != nil {
+			r.hub.log.Printf("error revoking sessions: %v", err)
+			return errors.New("error revoking sessions")
+		}
+		r.queueReq(peerReq{reqType: TypePeerRevoked, targetID: s.ID})
+	}
+
+	r.Broadcast(r.makePayload(payloadMsgPeer{ID: s.PeerID, Handle: s.Handle, Role: s.Role}, TypeRoomPassword), true)
+	r.hub.log.Printf("%s@%s: changed the password of %s (revoke sessions: %v)", s.Handle, s.PeerID, r.ID, revoke)
+	return nil
+}
+
+// disconnectPeers disconnects all the peers in the room but the ones with the
+// given session ID after their sessions have been revoked. The peers leave
+// the room once their connections are closed.
+func (r *Room) disconnectPeers(keepSessID string) {
+	for p := range r.peers {
+		if p.sessID != keepSessID {
+			p.disconnect(TypePeerRevoked)
+		}
+	}
+}
+
+// saveRoom persists the room's properties in the store.
+func (r *Room) saveRoom() error {
+	r.storeMu.Lock()
+	defer r.storeMu.Unlock()
+
+	if err := r.hub.Store.UpdateRoom(r.storeRoom()); err != nil {
+		r.hub.log.Printf("error updating room: %v", err)
+		return err
+	}
+	return nil
+}
+
+// storeRoom returns the room's properties as they're stored in the store.
+func (r *Room) storeRoom() store.Room {
+	var (
+		locked, lockedAt = r.lockState()
+		info             = r.Info()
+	)
+	return store.Room{
+		ID:         r.ID,
+		Name:       info.Name,
+		Password:   r.PasswordHash(),
+		CreatedAt:  r.CreatedAt,
+		E2E:        r.E2E,
+		MessageTTL: r.MessageTTL,
+		Locked:     locked,
+		LockedAt:   lockedAt,
+
+		Topic:       info.Topic,
+		Description: info.Description,
+		Public:      r.Public,
+		Tags:        r.Tags,
+		Settings:    &r.settings,
+	}
+}
+
+// changeHandle renames a peer across all its connections, persists the new
+// handle in the peer's session, and notifies the room. Peers can only change
+// their handles once every handleChangeInterval.
+func (r *Room) changeHandle(from *Peer, handle string) {
+	if handle == from.Handle {
+		return
+	}
+
+	if t, ok := r.handleChanges[from.ID]; ok && time.Since(t) < handleChangeInterval {
+		from.sendError(fmt.Sprintf("you can change your name only once every %v", handleChangeInterval))
+		return
+	}
+	r.handleChanges[from.ID] = time.Now()
+
+	old := from.Handle
+	for _, p := range r.findPeers(from.ID) {
+		p.Handle = handle
+	}
+
+	if err := r.hub.Store.UpdateSession(from.session(), r.ID); err != nil {
+		r.hub.log.Printf("error updating session: %v", err)
+	}
+	r.broadcast(r.makePayload(payloadMsgHandle{PeerID: from.ID, OldHandle: old, Handle: handle}, TypeHandle), true)
+	r.hub.log.Printf("%s@%s is now %s in %s", old, from.ID, handle, r.ID)
+}
+
+// sendDirect delivers a private message only to the target peer's
+// connections and echoes it back to the sender's. Private messages are
+// never recorded in the payload cache, so the room's message expiry is only
+// stamped on them for the peers to erase them.
+func (r *Room) sendDirect(from *Peer, targetID, msg string, env *payloadMsgEnvelope) {
+	targets := r.findPeers(targetID)
+	if len(targets) == 0 {
+		from.sendError("peer not found")
+		return
+	}
+
+	m := payloadMsgDirect{
+		payloadMsgChat: payloadMsgChat{
+			PeerID:     from.ID,
+			PeerHandle: from.Handle,
+			Msg:        msg,
+			Envelope:   env,
+		},
+		ToID:     targets[0].ID,
+		ToHandle: targets[0].Handle,
+	}
+	if r.MessageTTL > 0 {
+		t := time.Now().Add(r.MessageTTL)
+		m.ExpiresAt = &t
+	}
+	b := r.makePayload(m, TypeMessageDirect)
+
+	for p := range r.peers {
+		if p.ID == targetID || p.ID == from.ID {
+			p.SendData(b)
+		}
+	}
+}
+
+// moderatePeer kicks, bans, mutes, or unmutes a connected peer on behalf of
+// a privileged peer.
+func (r *Room) moderatePeer(from *Peer, action, targetID string) {
+	targets := r.findPeers(targetID)
+	if len(targets) == 0 {
+		from.sendError("peer not found")
+		return
+	}
+
+	t := targets[0]
+	if roleRanks[from.Role] <= roleRanks[t.Role] {
+		from.sendError("you can't do that to this peer")
+		return
+	}
+
+	switch action {
+	case TypePeerMute, TypePeerUnmute:
+		for _, p := range targets {
+			p.muted.Store(action == TypePeerMute)
+		}
+		if err := r.hub.Store.UpdateSession(t.session(), r.ID); err != nil {
+			r.hub.log.Printf("error updating session: %v", err)
+		}
+		r.broadcast(r.makePeerUpdatePayload(t, action), false)
+
+	case TypePeerKick, TypePeerBan:
+		if action == TypePeerBan {
+			for _, p := range targets {
+				if err := r.hub.Store.BanPeer(r.ID, p.Handle, p.ip, r.hub.cfg.BanDuration); err != nil {
+					r.hub.log.Printf("error banning peer: %v", err)
+				}
+			}
+		}
+
+		if err := r.hub.Store.RemoveSession(t.sessID, r.ID); err != nil {
+			r.hub.log.Printf("error removing session: %v", err)
+		}
+		for _, p := range targets {
+			p.disconnect(action)
+		}
+		r.broadcast(r.makePeerUpdatePayload(t, action), true)
+	}
+
+	r.hub.log.Printf("%s@%s: %s %s@%s in %s", from.Handle, from.ID, action, t.Handle, t.ID, r.ID)
+}
+
+// findPeers returns the connections of the peer with the given ID. A peer
+// may be connected more than once (eg: multiple tabs).
+func (r *Room) findPeers(id string) []*Peer {
+	var out []*Peer
+	for p := range r.peers {
+		if p.ID == id {
+			out = append(out, p)
+		}
+	}
+	return out
 }
 
 // sendPeerList sends the peer list to the given peer.
 func (r *Room) sendPeerList(p *Peer) {
-	r.peerQ <- peerReq{reqType: TypePeerList, peer: p}
+	r.queueReq(peerReq{reqType: TypePeerList, peer: p})
 }
 
 // makePeerListPayload prepares a message payload with the list of peers.
 func (r *Room) makePeerListPayload() []byte {
 	peers := make([]payloadMsgPeer, 0, len(r.peers))
 	for p := range r.peers {
-		peers = append(peers, payloadMsgPeer{ID: p.ID, Handle: p.Handle})
+		peers = append(peers, payloadMsgPeer{ID: p.ID, Handle: p.Handle, Role: p.Role, Muted: p.muted.Load()})
 	}
 	return r.makePayload(peers, TypePeerList)
 }
@@ -249,24 +1067,63 @@ func (r *Room) makePeerUpdatePayload(p *Peer, peerUpdateType string) []byte {
 	d := payloadMsgPeer{
 		ID:     p.ID,
 		Handle: p.Handle,
+		Role:   p.Role,
+		Muted:  p.muted.Load(),
 	}
 	return r.makePayload(d, peerUpdateType)
 }
 
-// makeMessagePayload prepares a chat message.
-func (r *Room) makeMessagePayload(msg string, p *Peer) []byte {
-	d := payloadMsgChat{
-		PeerID:     p.ID,
-		PeerHandle: p.Handle,
-		Msg:        msg,
+// makePeerInfoPayload prepares a message payload with a peer's own info and
+// the room's expiry deadlines.
+func (r *Room) makePeerInfoPayload(p *Peer) []byte {
+	d := payloadMsgPeerInfo{
+		payloadMsgPeer: payloadMsgPeer{
+			ID:     p.ID,
+			Handle: p.Handle,
+			Role:   p.Role,
+			Muted:  p.muted.Load(),
+		},
+		IdleTimeout:   int(r.hub.cfg.RoomTimeout.Seconds()),
+		IdleExpiresAt: r.idleDeadline(),
+		E2E:           r.E2E,
+		MessageTTL:    int(r.MessageTTL.Seconds()),
+		Locked:        r.Locked(),
+		MaxPeers:      r.settings.MaxPeers,
+		MaxMessageLen: r.settings.MaxMessageLen,
+		Room:          r.Info(),
+	}
+	if r.hub.cfg.RoomMaxAge > 0 {
+		t := r.CreatedAt.Add(r.hub.cfg.RoomMaxAge)
+		d.ExpiresAt = &t
 	}
-	return r.makePayload(d, TypeMessage)
+	return r.makePayload(d, TypePeerInfo)
 }
 
 // makePayload prepares a message payload.
 func (r *Room) makePayload(data any, typ string) []byte {
+	return r.makePayloadAt(data, typ, time.Now())
+}
+
+// setSeq sets the sequence number of an encoded payload.
+func setSeq(b []byte, seq uint64) []byte {
+	var (
+		m payloadMsgWrap
+		d json.RawMessage
+	)
+	m.Data = &d
+	if err := json.Unmarshal(b, &m); err != nil {
+		return b
+	}
+
+	m.Seq = seq
+	out, _ := json.Marshal(m)
+	return out
+}
+
+// makePayloadAt prepares a message payload with the given timestamp.
+func (r *Room) makePayloadAt(data any, typ string, ts time.Time) []byte {
 	m := payloadMsgWrap{
-		Timestamp: time.Now(),
+		Timestamp: ts,
 		Type:      typ,
 		Data:      data,
 	}
@@ -0,0 +1,87 @@
+package hub
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Bounds of the settings that rooms can be created with, in addition to the
+// app's limits. They're relaxed to the app's defaults if those are beyond
+// them.
+const (
+	minRoomPeers         = 2
+	minRoomMessageLen    = 100
+	minRoomAge           = time.Minute
+	maxRateLimitInterval = time.Minute
+)
+
+// RoomLimits represents the maximum settings that rooms can be created with.
+// Unset limits default to the app's settings, which rooms can then only
+// lower.
+type RoomLimits struct {
+	MaxPeersPerRoom   int           `koanf:"max_peers_per_room"`
+	MaxCachedMessages int           `koanf:"max_cached_messages"`
+	MaxMessageLen     int           `koanf:"max_message_length"`
+	RateLimitMessages int           `koanf:"rate_limit_messages"`
+	RoomAge           time.Duration `koanf:"room_age"`
+}
+
+// DefaultSettings returns the settings that rooms get unless they're created
+// with others.
+func (h *Hub) DefaultSettings() store.RoomSettings {
+	return store.RoomSettings{
+		MaxPeers:          h.cfg.MaxPeersPerRoom,
+		MaxCachedMessages: h.cfg.MaxCachedMessages,
+		MaxMessageLen:     h.cfg.MaxMessageLen,
+		RateLimitMessages: h.cfg.RateLimitMessages,
+		RateLimitInterval: h.cfg.RateLimitInterval,
+		RoomAge:           h.cfg.RoomAge,
+	}
+}
+
+// CheckSettings checks a room's settings against app.room_limits. The rate
+// limit interval can only be made longer than app.rate_limit_interval so
+// that rooms can't send messages faster than the limits permit. The app's
+// defaults always pass.
+func (h *Hub) CheckSettings(s store.RoomSettings) error {
+	var (
+		l = h.cfg.RoomLimits
+		d = h.DefaultSettings()
+
+		minPeers    = min(minRoomPeers, d.MaxPeers)
+		minMsgLen   = min(minRoomMessageLen, d.MaxMessageLen)
+		minAge      = min(minRoomAge, d.RoomAge)
+		maxInterval = max(maxRateLimitInterval, d.RateLimitInterval)
+	)
+	switch {
+	case s.MaxPeers < minPeers || s.MaxPeers > l.MaxPeersPerRoom:
+		return fmt.Errorf("max peers should be between %d and %d", minPeers, l.MaxPeersPerRoom)
+
+	case s.MaxCachedMessages < 0 || s.MaxCachedMessages > l.MaxCachedMessages:
+		return fmt.Errorf("cached messages should be between 0 and %d", l.MaxCachedMessages)
+
+	case s.MaxMessageLen < minMsgLen || s.MaxMessageLen > l.MaxMessageLen:
+		return fmt.Errorf("max message length should be between %d and %d", minMsgLen, l.MaxMessageLen)
+
+	case s.RateLimitMessages < 1 || s.RateLimitMessages > l.RateLimitMessages:
+		return fmt.Errorf("rate limit messages should be between 1 and %d", l.RateLimitMessages)
+
+	case s.RateLimitInterval < d.RateLimitInterval || s.RateLimitInterval > maxInterval:
+		return fmt.Errorf("rate limit interval should be between %v and %v", d.RateLimitInterval, maxInterval)
+
+	case s.RoomAge < minAge || s.RoomAge > l.RoomAge:
+		return fmt.Errorf("room age should be between %v and %v", minAge, l.RoomAge)
+	}
+	return nil
+}
+
+// roomSettings returns the settings of a room in the store, or the defaults
+// if the room doesn't have any.
+func (h *Hub) roomSettings(r store.Room) store.RoomSettings {
+	if r.Settings == nil {
+		return h.DefaultSettings()
+	}
+	return *r.Settings
+}
@@ -20,6 +20,9 @@ import (
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/posflag"
+	"github.com/knadh/niltalk/blob"
+	"github.com/knadh/niltalk/blob/disk"
+	blobmem "github.com/knadh/niltalk/blob/mem"
 	"github.com/knadh/niltalk/internal/hub"
 	"github.com/knadh/niltalk/store"
 	"github.com/knadh/niltalk/store/fs"
@@ -180,6 +183,71 @@ func main() {
 		logger.Fatal("app.websocket_timeout and app.roomage should be > 3s")
 	}
 
+	// Older configs don't have a separate inactivity timeout.
+	if app.cfg.RoomTimeout == 0 {
+		app.cfg.RoomTimeout = app.cfg.RoomAge
+	} else if app.cfg.RoomTimeout < minTime {
+		logger.Fatal("app.room_timeout should be > 3s")
+	}
+
+	if app.cfg.BanDuration == 0 {
+		app.cfg.BanDuration = time.Hour
+	}
+
+	if app.cfg.RateLimitMessages < 1 || app.cfg.RateLimitInterval <= 0 {
+		logger.Fatal("app.rate_limit_messages and app.rate_limit_interval should be > 0")
+	}
+	if app.cfg.RateLimitMuteDuration == 0 {
+		app.cfg.RateLimitMuteDuration = time.Second * 30
+	}
+	if app.cfg.RateLimitMaxViolations < 1 {
+		app.cfg.RateLimitMaxViolations = 3
+	}
+
+	if app.cfg.MaxMessageQueue < 1 {
+		app.cfg.MaxMessageQueue = 100
+	}
+
+	switch app.cfg.SlowPeerPolicy {
+	case "":
+		app.cfg.SlowPeerPolicy = hub.SlowPeerDisconnect
+	case hub.SlowPeerDropOldest, hub.SlowPeerDropNewest, hub.SlowPeerDisconnect:
+	default:
+		logger.Fatal("app.slow_peer_policy must be one of drop_oldest|drop_newest|disconnect")
+	}
+
+	// Rooms can be created with settings up to app.room_limits. Unset
+	// limits default to the app's settings.
+	lim := &app.cfg.RoomLimits
+	if lim.MaxPeersPerRoom == 0 {
+		lim.MaxPeersPerRoom = app.cfg.MaxPeersPerRoom
+	}
+	if lim.MaxCachedMessages == 0 {
+		lim.MaxCachedMessages = app.cfg.MaxCachedMessages
+	}
+	if lim.MaxMessageLen == 0 {
+		lim.MaxMessageLen = app.cfg.MaxMessageLen
+	}
+	if lim.RateLimitMessages == 0 {
+		lim.RateLimitMessages = app.cfg.RateLimitMessages
+	}
+	if lim.RoomAge == 0 {
+		lim.RoomAge = app.cfg.RoomAge
+	}
+	if lim.MaxPeersPerRoom < app.cfg.MaxPeersPerRoom || lim.MaxCachedMessages < app.cfg.MaxCachedMessages ||
+		lim.MaxMessageLen < app.cfg.MaxMessageLen || lim.RateLimitMessages < app.cfg.RateLimitMessages ||
+		lim.RoomAge < app.cfg.RoomAge {
+		logger.Fatal("app.room_limits should be >= their app defaults")
+	}
+
+	switch app.cfg.RoomLimitPolicy {
+	case "":
+		app.cfg.RoomLimitPolicy = hub.RoomLimitReject
+	case hub.RoomLimitReject, hub.RoomLimitEvictIdle:
+	default:
+		logger.Fatal("app.room_limit_policy must be one of reject|evict_idle")
+	}
+
 	// Initialize store.
 	var store store.Store
 	switch app.cfg.Storage {
@@ -223,6 +291,42 @@ func main() {
 		logger.Fatal("app.storage must be one of redis|memory|fs")
 	}
 
+	// Initialize the blob store for the files shared in rooms. File sharing
+	// is disabled if there's no max_file_size.
+	var files blob.Store
+	if app.cfg.MaxFileSize > 0 {
+		if app.cfg.MaxRoomFilesSize < app.cfg.MaxFileSize {
+			logger.Fatal("app.max_room_files_size should be >= app.max_file_size")
+		}
+		if app.cfg.MaxFilesSize < app.cfg.MaxRoomFilesSize {
+			logger.Fatal("app.max_files_size should be >= app.max_room_files_size")
+		}
+
+		switch app.cfg.FileStorage {
+		case "disk":
+			var filesCfg disk.Config
+			if err := ko.Unmarshal("files", &filesCfg); err != nil {
+				logger.Fatalf("error unmarshalling 'files' config: %v", err)
+			}
+
+			f, err := disk.New(filesCfg)
+			if err != nil {
+				log.Fatalf("error initializing file store: %v", err)
+			}
+			files = f
+
+		case "memory":
+			f, err := blobmem.New(blobmem.Config{})
+			if err != nil {
+				log.Fatalf("error initializing file store: %v", err)
+			}
+			files = f
+
+		default:
+			logger.Fatal("app.file_storage must be one of disk|memory")
+		}
+	}
+
 	if ko.Bool("onion") {
 		pk, err := getOrCreatePK(store)
 		if err != nil {
@@ -232,7 +336,12 @@ func main() {
 		os.Exit(0)
 	}
 
-	app.hub = hub.NewHub(app.cfg, store, logger)
+	app.hub = hub.NewHub(app.cfg, store, files, logger)
+
+	// Rooms created without settings get the app's, which have to be valid.
+	if err := app.hub.CheckSettings(app.hub.DefaultSettings()); err != nil {
+		logger.Fatalf("invalid room settings in the config: %v", err)
+	}
 
 	// Compile static templates.
 	tpl, err := stuffbin.ParseTemplatesGlob(nil, app.fs, "/static/templates/*.html")
@@ -249,10 +358,22 @@ func main() {
 	// API.
 	r.Post("/api/rooms/{roomID}/login", wrap(handleLogin, app, hasRoom))
 	r.Delete("/api/rooms/{roomID}/login", wrap(handleLogout, app, hasAuth|hasRoom))
+	r.Get("/api/rooms", wrap(handleGetRooms, app, 0))
 	r.Post("/api/rooms", wrap(handleCreateRoom, app, 0))
+	r.Patch("/api/rooms/{roomID}", wrap(handleUpdateRoom, app, hasAuth|hasRoom))
+	r.Put("/api/rooms/{roomID}/password", wrap(handleChangePassword, app, hasAuth|hasRoom))
+	r.Post("/api/notices", wrap(handleNotice, app, hasAdmin))
+	r.Post("/api/rooms/{roomID}/invite/{token}", wrap(handleInviteLogin, app, hasRoom))
+	r.Get("/api/rooms/{roomID}/invites", wrap(handleGetInvites, app, hasAuth|hasRoom))
+	r.Post("/api/rooms/{roomID}/invites", wrap(handleCreateInvite, app, hasAuth|hasRoom))
+	r.Delete("/api/rooms/{roomID}/invites/{inviteID}", wrap(handleRevokeInvite, app, hasAuth|hasRoom))
+	r.Post("/api/rooms/{roomID}/files", wrap(handleUploadFile, app, hasAuth|hasRoom))
+	r.Get("/api/rooms/{roomID}/files/{fileID}", wrap(handleGetFile, app, hasAuth|hasRoom))
 
 	// Views.
-	r.Get("/r/{roomID}", wrap(handleRoomPage, app, hasAuth|hasRoom))
+	r.Get("/rooms", wrap(handleRoomsPage, app, 0))
+	r.Get("/r/{roomID}", wrap(handleRoomPage, app, hasAuth|hasRoom|isPage))
+	r.Get("/r/{roomID}/invite/{token}", wrap(handleInvitePage, app, hasAuth|hasRoom|isPage))
 	r.Get("/static/*", func(w http.ResponseWriter, r *http.Request) {
 		app.fs.FileServer().ServeHTTP(w, r)
 	})
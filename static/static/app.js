@@ -4,6 +4,26 @@ const notifType = {
     error: "error"
 };
 const typingDebounceInterval = 3000;
+const readDebounceInterval = 2000;
+const replySnippetLen = 100;
+const quickReactions = ["👍", "✅", "👀", "❤️", "😂"];
+const messageTTLs = [
+    { ttl: 0, label: "Never" },
+    { ttl: 30, label: "30 seconds" },
+    { ttl: 300, label: "5 minutes" },
+    { ttl: 3600, label: "1 hour" },
+    { ttl: 86400, label: "1 day" }
+];
+const inviteTTLs = {
+    "1h": 3600,
+    "1d": 86400,
+    "7d": 604800
+};
+const roles = {
+    peer: "peer",
+    moderator: "moderator",
+    owner: "owner"
+};
 
 Vue.component("expand-link", {
     props: ["link"],
@@ -49,12 +69,64 @@ var app = new Vue({
         typingTimer: null,
         typingPeers: new Map(),
 
+        // Peer to whom messages are sent privately, if any.
+        directPeer: null,
+
+        // Message being replied to, if any.
+        replyTo: null,
+
+        // Secret of an E2E room from the URL fragment, which the messages
+        // are encrypted with.
+        secret: "",
+
+        // Name, topic, and description of the room and the form to edit
+        // them with.
+        room: {},
+        roomForm: null,
+
+        // Unexpired invites to the room, only fetched by the owner.
+        invites: [],
+
+        // Last messages seen by peers (peer ID => message ID) and the last
+        // message reported as seen by self.
+        reads: {},
+        lastRead: "",
+        readTimer: null,
+
+        // Expiry (seconds) of messages sent and the current time (ms) by
+        // which the expiring messages count down.
+        messageTTL: 0,
+        now: Date.now(),
+
+        // Room expiry deadlines (ms) and the countdown to the nearest one.
+        idleTimeout: 0,
+        idleExpiresAt: 0,
+        expiresAt: 0,
+        countdown: "",
+
         // Form fields.
         roomName: "",
         handle: "",
         password: "",
+        e2e: false,
+        isPublic: false,
+        description: "",
+        tags: "",
+        showSettings: false,
+        settings: {
+            max_peers: "",
+            max_cached_messages: "",
+            max_message_length: "",
+            rate_limit_messages: "",
+            rate_limit_interval: "",
+            room_age: ""
+        },
+        roomTTL: 0,
         message: "",
 
+        quickReactions: quickReactions,
+        messageTTLs: messageTTLs,
+
         // Chat data.
         self: {},
         messages: [],
@@ -63,6 +135,7 @@ var app = new Vue({
     created: function () {
         this.initClient();
         this.initTimers();
+        this.initCrypto();
 
         if (window.hasOwnProperty("_room") && _room.auth) {
             this.toggleChat();
@@ -73,6 +146,15 @@ var app = new Vue({
     computed: {
         Client() {
             return window.Client;
+        },
+
+        // Owners and moderators can dispose of the room.
+        isPrivileged() {
+            return this.self.role === roles.owner || this.self.role === roles.moderator;
+        },
+
+        isOwner() {
+            return this.self.role === roles.owner;
         }
     },
     methods: {
@@ -82,7 +164,14 @@ var app = new Vue({
                 method: "post",
                 body: JSON.stringify({
                     name: this.roomName,
-                    password: this.password
+                    handle: this.handle.replace(/[^a-z0-9_\-\.@]/ig, ""),
+                    password: this.isPublic ? "" : this.password,
+                    e2e: !this.isPublic && this.e2e,
+                    message_ttl: parseInt(this.roomTTL),
+                    public: this.isPublic,
+                    description: this.isPublic ? this.description : "",
+                    tags: this.isPublic ? this.tags.split(",").map(t => t.trim()).filter(t => t) : [],
+                    settings: this.roomSettings()
                 }),
                 headers: { "Content-Type": "application/json; charset=utf-8" }
             })
@@ -92,7 +181,9 @@ var app = new Vue({
                     if (resp.error) {
                         this.notify(resp.error, notifType.error);
                     } else {
-                        document.location.replace("/r/" + resp.data.id);
+                        // The secret of an E2E room only ever lives in the URL fragment.
+                        const hash = this.e2e && !this.isPublic ? "#" + Crypto.newSecret() : "";
+                        document.location.replace("/r/" + resp.data.id + hash);
                     }
                 })
                 .catch(err => {
@@ -101,12 +192,28 @@ var app = new Vue({
                 });
         },
 
-        // Login to a room.
+        // Settings of a new room that have been changed from the defaults.
+        // The room's age is picked in hours.
+        roomSettings() {
+            const out = {};
+            for (const k in this.settings) {
+                if (this.settings[k] !== "") {
+                    out[k] = parseInt(this.settings[k]);
+                }
+            }
+            if (out.hasOwnProperty("room_age")) {
+                out.room_age *= 3600;
+            }
+            return out;
+        },
+
+        // Login to a room, with an invite if the room was opened with one.
         handleLogin() {
-            const handle = this.handle.replace(/[^a-z0-9_\-\.@]/ig, "");
+            const handle = this.handle.replace(/[^a-z0-9_\-\.@]/ig, ""),
+                url = _room.invite ? "/invite/" + _room.invite : "/login";
 
             this.notify("Logging in", notifType.notice);
-            fetch("/api/rooms/" + _room.id + "/login", {
+            fetch("/api/rooms/" + _room.id + url, {
                 method: "post",
                 body: JSON.stringify({ handle: handle, password: this.password }),
                 headers: { "Content-Type": "application/json; charset=utf-8" }
@@ -120,6 +227,12 @@ var app = new Vue({
                         return;
                     }
 
+                    // The invite is used up. Move to the room's own URL.
+                    if (_room.invite) {
+                        history.replaceState(null, "", "/r/" + _room.id + location.hash);
+                        _room.invite = "";
+                    }
+
                     this.clear();
                     this.deNotify();
                     this.toggleChat();
@@ -160,12 +273,61 @@ var app = new Vue({
         },
 
         handleSendMessage() {
-            Client.sendMessage(Client.MsgType["message"], this.message);
+            const directPeer = this.directPeer,
+                replyTo = this.replyTo,
+                ttl = parseInt(this.messageTTL);
+
+            this.makeContent(this.message).then(c => {
+                if (ttl > 0) {
+                    c.ttl = ttl;
+                }
+
+                if (directPeer) {
+                    Client.sendMessage(Client.MsgType["message.direct"], { peer_id: directPeer.id, ...c });
+                } else if (replyTo) {
+                    Client.sendMessage(Client.MsgType["message"], { ...c, reply_to: replyTo.id });
+                } else {
+                    Client.sendMessage(Client.MsgType["message"], c);
+                }
+            }).catch(err => {
+                this.notify(err, notifType.error);
+            });
+
+            this.replyTo = null;
             this.message = "";
             window.clearTimeout(this.typingTimer);
             this.typingTimer = null;
         },
 
+        // Share a file in the room. It's broadcast to the room as a file message.
+        handleUploadFile(e) {
+            const f = e.target.files[0];
+            if (!f) {
+                return;
+            }
+
+            const data = new FormData();
+            data.append("file", f);
+            e.target.value = "";
+
+            this.notify("Uploading " + f.name, notifType.notice);
+            fetch("/api/rooms/" + _room.id + "/files", {
+                method: "post",
+                body: data
+            })
+                .then(resp => resp.json())
+                .then(resp => {
+                    if (resp.error) {
+                        this.notify(resp.error, notifType.error);
+                        return;
+                    }
+                    this.deNotify();
+                })
+                .catch(err => {
+                    this.notify(err, notifType.error);
+                });
+        },
+
         handleLogout() {
             if (!confirm("Logout?")) {
                 return;
@@ -184,6 +346,123 @@ var app = new Vue({
                 });
         },
 
+        // Fetch the room's unexpired invites.
+        fetchInvites() {
+            fetch("/api/rooms/" + _room.id + "/invites")
+                .then(resp => resp.json())
+                .then(resp => {
+                    if (resp.error) {
+                        this.notify(resp.error, notifType.error);
+                        return;
+                    }
+                    this.invites = resp.data;
+                })
+                .catch(err => {
+                    this.notify(err, notifType.error);
+                });
+        },
+
+        // Create an invite that lets peers in without the password.
+        handleCreateInvite() {
+            const uses = prompt("How many times can the invite be used?", "1");
+            if (!uses) {
+                return;
+            }
+            const ttl = prompt("When does the invite expire? (" + Object.keys(inviteTTLs).join(", ") + ")", "1d");
+            if (!inviteTTLs.hasOwnProperty(ttl)) {
+                return;
+            }
+
+            fetch("/api/rooms/" + _room.id + "/invites", {
+                method: "post",
+                body: JSON.stringify({ max_uses: parseInt(uses), ttl: inviteTTLs[ttl] }),
+                headers: { "Content-Type": "application/json; charset=utf-8" }
+            })
+                .then(resp => resp.json())
+                .then(resp => {
+                    if (resp.error) {
+                        this.notify(resp.error, notifType.error);
+                        return;
+                    }
+                    this.invites.push(resp.data);
+                })
+                .catch(err => {
+                    this.notify(err, notifType.error);
+                });
+        },
+
+        handleRevokeInvite(inv) {
+            if (!confirm("Revoke the invite?")) {
+                return;
+            }
+            fetch("/api/rooms/" + _room.id + "/invites/" + inv.id, {
+                method: "delete"
+            })
+                .then(resp => resp.json())
+                .then(resp => {
+                    if (resp.error) {
+                        this.notify(resp.error, notifType.error);
+                    }
+                    this.invites = this.invites.filter(i => i.id !== inv.id);
+                })
+                .catch(err => {
+                    this.notify(err, notifType.error);
+                });
+        },
+
+        // Link of an invite. Invites to E2E rooms carry the room's secret.
+        inviteLink(inv) {
+            return inv.url + (this.secret ? "#" + this.secret : "");
+        },
+
+        // Edit the room's name, topic, and description.
+        handleEditRoom() {
+            this.roomForm = { ...this.room };
+        },
+
+        handleUpdateRoom() {
+            Client.sendMessage(Client.MsgType["room.update"], {
+                name: this.roomForm.name,
+                topic: this.roomForm.topic,
+                description: this.roomForm.description
+            });
+            this.roomForm = null;
+        },
+
+        // Change the room's password, optionally logging out everyone else.
+        handleChangePassword() {
+            const password = prompt("New password for the room (6 to 100 characters)");
+            if (!password) {
+                return;
+            }
+            const revoke = confirm("Log out everyone else? They'll have to log in again with the new password.");
+
+            fetch("/api/rooms/" + _room.id + "/password", {
+                method: "put",
+                body: JSON.stringify({ password: password, revoke_sessions: revoke }),
+                headers: { "Content-Type": "application/json; charset=utf-8" }
+            })
+                .then(resp => resp.json())
+                .then(resp => {
+                    if (resp.error) {
+                        this.notify(resp.error, notifType.error);
+                        return;
+                    }
+                    this.notify("Password changed", notifType.notice);
+                })
+                .catch(err => {
+                    this.notify(err, notifType.error);
+                });
+        },
+
+        // Lock the room to new peers or unlock it.
+        handleLockRoom() {
+            if (!this.self.locked && !confirm("Lock the room? Only the peers who've already joined can rejoin.")) {
+                return;
+            }
+            Client.sendMessage(Client.MsgType[this.self.locked ? "room.unlock" : "room.lock"]);
+        },
+
         handleDisposeRoom() {
             if (!confirm("Disconnect all peers and destroy this room?")) {
                 return;
@@ -191,6 +470,86 @@ var app = new Vue({
             Client.sendMessage(Client.MsgType["room.dispose"]);
         },
 
+        // Only the author and privileged peers can edit or delete a message.
+        canAlterMessage(m) {
+            return m.id && (m.peer.id === this.self.id || this.isPrivileged);
+        },
+
+        handleEditMessage(m) {
+            const msg = prompt("Edit message", m.message);
+            if (msg === null || msg === m.message) {
+                return;
+            }
+            this.makeContent(msg).then(c => {
+                Client.sendMessage(Client.MsgType["message.edit"], { id: m.id, ...c });
+            }).catch(err => {
+                this.notify(err, notifType.error);
+            });
+        },
+
+        handleDeleteMessage(m) {
+            if (!confirm("Delete this message?")) {
+                return;
+            }
+            Client.sendMessage(Client.MsgType["message.delete"], { id: m.id });
+        },
+
+        handleReply(m) {
+            this.directPeer = null;
+            this.replyTo = m;
+            this.$refs["form-message"].focus();
+        },
+
+        // Snippet of the message being replied to. The server can't make
+        // snippets of encrypted messages, so they're made from the messages
+        // in the room.
+        replySnippet(m) {
+            if (m.reply.snippet) {
+                return m.reply.snippet;
+            }
+
+            const p = this.messages.find(p => p.id === m.replyTo);
+            return p ? [...p.message].slice(0, replySnippetLen).join("") : "";
+        },
+
+        handleReact(m, reaction) {
+            Client.sendMessage(Client.MsgType["message.react"], { id: m.id, reaction: reaction });
+        },
+
+        // Toggle private messaging with a peer.
+        handleDirectPeer(peer) {
+            this.replyTo = null;
+            this.directPeer = peer;
+            this.$refs["form-message"].focus();
+        },
+
+        // Promote a peer to a moderator or demote them back.
+        handleSetRole(peer, role) {
+            Client.sendMessage(Client.MsgType["peer.role"], { peer_id: peer.id, role: role });
+        },
+
+        // Kick, ban, mute, or unmute a peer.
+        handleModerate(peer, typ) {
+            if ((typ === Client.MsgType["peer.kick"] || typ === Client.MsgType["peer.ban"]) &&
+                !confirm("Remove " + peer.handle + " from the room?")) {
+                return;
+            }
+            Client.sendMessage(typ, { peer_id: peer.id });
+        },
+
+        // Change own handle.
+        handleChangeHandle() {
+            let handle = prompt("Change your name", this.self.handle);
+            if (handle === null) {
+                return;
+            }
+            handle = handle.replace(/[^a-z0-9_\-\.@]/ig, "");
+            if (handle === "" || handle === this.self.handle) {
+                return;
+            }
+            Client.sendMessage(Client.MsgType["handle"], { handle: handle });
+        },
+
         // Flash notification.
         notify(msg, typ, timeout) {
             clearTimeout(this.notifTimer);
@@ -237,6 +596,25 @@ var app = new Vue({
                 + " " + (h > 12 ? "PM" : "AM");
         },
 
+        formatDuration(ms) {
+            const s = Math.max(0, Math.floor(ms / 1000)),
+                pad = (n) => (n < 10 ? "0" : "") + n;
+            return pad(Math.floor(s / 3600)) + ":" + pad(Math.floor(s % 3600 / 60)) + ":" + pad(s % 60);
+        },
+
+        formatSize(n) {
+            const units = ["bytes", "KB", "MB", "GB"];
+            let i = 0;
+            for (; n >= 1000 && i < units.length - 1; i++) {
+                n /= 1000;
+            }
+            return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+        },
+
+        isImage(f) {
+            return f.type.indexOf("image/") === 0;
+        },
+
         formatMessage(text) {
             const div = document.createElement("div");
             div.appendChild(document.createTextNode(text));
@@ -295,6 +673,10 @@ var app = new Vue({
                     this.notify("Disconnected. Retrying ...", notifType.notice);
                     break;
 
+                case Client.MsgType["peer.slow"]:
+                    this.notify("Your connection is too slow. Reconnecting ...", notifType.notice);
+                    break;
+
                 case Client.MsgType["peer.ratelimited"]:
                     this.notify("You sent too many messages", notifType.error);
                     this.toggleChat();
@@ -305,6 +687,22 @@ var app = new Vue({
                     this.toggleChat();
                     break;
 
+                case Client.MsgType["room.locked"]:
+                    this.notify("Room is locked", notifType.error);
+                    this.toggleChat();
+                    break;
+
+                case Client.MsgType["peer.revoked"]:
+                    this.notify("The room's password was changed. Login again", notifType.error);
+                    this.toggleChat();
+                    break;
+
+                case Client.MsgType["peer.kick"]:
+                case Client.MsgType["peer.ban"]:
+                    this.notify("You were removed from the room", notifType.error);
+                    this.toggleChat();
+                    break;
+
                 case Client.MsgType["room.dispose"]:
                     this.notify("Room diposed", notifType.error);
                     this.toggleChat();
@@ -321,8 +719,53 @@ var app = new Vue({
         onPeerSelf(data) {
             this.self = {
                 ...data.data,
+                locked: data.data.locked || false,
                 avatar: this.hashColor(data.data.id)
             };
+
+            if (data.data.e2e && !Crypto.ready()) {
+                this.notify("This room is end-to-end encrypted. Open it with its full link to read and send messages",
+                    notifType.error, 10000);
+            }
+
+            this.idleTimeout = data.data.idle_timeout * 1000;
+            this.idleExpiresAt = Date.parse(data.data.idle_expires_at);
+            this.expiresAt = data.data.expires_at ? Date.parse(data.data.expires_at) : 0;
+
+            if (this.isOwner) {
+                this.fetchInvites();
+            }
+            this.setRoomInfo(data.data.room);
+        },
+
+        // Update the room's info and the page title with it.
+        setRoomInfo(info) {
+            this.room = { id: _room.id, ...info };
+            this.pageTitle = (info.name ? info.name + " - " : "") + "Niltalk";
+            document.title = this.pageTitle;
+        },
+
+        onRoomPassword(data) {
+            const peer = data.data;
+            peer.avatar = this.hashColor(peer.id);
+            this.messages.push({
+                type: Client.MsgType["room.password"],
+                peer: peer,
+                timestamp: data.timestamp
+            });
+            this.scrollToNewester();
+        },
+
+        onRoomUpdate(data) {
+            const d = data.data;
+            this.setRoomInfo({ name: d.name, topic: d.topic, description: d.description });
+
+            this.messages.push({
+                type: Client.MsgType["room.update"],
+                peer: { id: d.peer_id, handle: d.peer_handle, avatar: this.hashColor(d.peer_id) },
+                timestamp: data.timestamp
+            });
+            this.scrollToNewester();
         },
 
         onPeerJoinLeave(data, typ) {
@@ -334,6 +777,9 @@ var app = new Vue({
                 peers.push(peer);
             } else {
                 peers = peers.filter((e) => { return e.id !== peer.id; });
+                if (this.directPeer && this.directPeer.id === peer.id) {
+                    this.directPeer = null;
+                }
             }
             this.onPeers(peers);
 
@@ -365,6 +811,151 @@ var app = new Vue({
             this.peers = peers;
         },
 
+        // Kick / ban / mute events. Without data, it's the WS close reason
+        // for this peer being removed.
+        onPeerModerated(data, typ) {
+            if (!data) {
+                this.onDisconnect(typ);
+                return;
+            }
+
+            const peer = data.data;
+            if (peer.id === this.self.id) {
+                this.self.muted = peer.muted;
+            }
+            this.peers.forEach(p => {
+                if (p.id === peer.id) {
+                    p.muted = peer.muted;
+                }
+            });
+
+            peer.avatar = this.hashColor(peer.id);
+            this.messages.push({
+                type: typ,
+                peer: peer,
+                timestamp: data.timestamp
+            });
+            this.scrollToNewester();
+        },
+
+        noticeText(m) {
+            switch (m.type) {
+                case Client.MsgType["peer.join"]:
+                    return "joined";
+                case Client.MsgType["peer.leave"]:
+                    return "left";
+                case Client.MsgType["peer.kick"]:
+                    return "was kicked";
+                case Client.MsgType["peer.ban"]:
+                    return "was banned";
+                case Client.MsgType["peer.mute"]:
+                    return "was muted";
+                case Client.MsgType["peer.unmute"]:
+                    return "was unmuted";
+                case Client.MsgType["handle"]:
+                    return "is now " + m.handle;
+                case Client.MsgType["room.lock"]:
+                    return "locked the room";
+                case Client.MsgType["room.unlock"]:
+                    return "unlocked the room";
+                case Client.MsgType["room.update"]:
+                    return "updated the room's name, topic, or description";
+                case Client.MsgType["room.password"]:
+                    return "changed the room's password";
+            }
+            return "";
+        },
+
+        onMessageEdit(data) {
+            const m = this.messages.find(m => m.id === data.data.id);
+            if (m) {
+                m.message = data.data.message;
+                m.edited = true;
+                this.decryptMessage(m, data.data.envelope);
+            }
+        },
+
+        onMessageReact(data) {
+            const m = this.messages.find(m => m.id === data.data.id);
+            if (m) {
+                m.reactions = data.data.reactions || {};
+            }
+        },
+
+        onMessageDelete(data) {
+            this.messages = this.messages.filter(m => m.id !== data.data.id);
+            if (this.replyTo && this.replyTo.id === data.data.id) {
+                this.replyTo = null;
+            }
+        },
+
+        onPeerRole(data) {
+            this.peers.forEach(p => {
+                if (p.id === data.data.peer_id) {
+                    p.role = data.data.role;
+                }
+            });
+        },
+
+        onHandle(data) {
+            const d = data.data;
+            if (d.peer_id === this.self.id) {
+                this.self.handle = d.handle;
+            }
+            this.peers.forEach(p => {
+                if (p.id === d.peer_id) {
+                    p.handle = d.handle;
+                }
+            });
+
+            this.messages.push({
+                type: data.type,
+                handle: d.handle,
+                peer: {
+                    id: d.peer_id,
+                    handle: d.old_handle,
+                    avatar: this.hashColor(d.peer_id)
+                },
+                timestamp: data.timestamp
+            });
+            this.scrollToNewester();
+        },
+
+        onRoomLock(data, typ) {
+            this.self.locked = typ === Client.MsgType["room.lock"];
+
+            const peer = data.data;
+            peer.avatar = this.hashColor(peer.id);
+            this.messages.push({
+                type: typ,
+                peer: peer,
+                timestamp: data.timestamp
+            });
+            this.scrollToNewester();
+        },
+
+        // Notice from the server.
+        onNotice(data) {
+            this.messages.push({
+                type: data.type,
+                message: data.data.message,
+                timestamp: data.timestamp
+            });
+            this.scrollToNewester();
+        },
+
+        onTruncated(data) {
+            this.notify("Some messages were missed while disconnected", notifType.notice, 5000);
+        },
+
+        onWarning(data) {
+            this.notify(data.data.message, notifType.error, 5000);
+        },
+
+        onError(data) {
+            this.notify(data.data, notifType.error);
+        },
+
         onTyping(data) {
             if (data.data.id === this.self.id) {
                 return;
@@ -381,11 +972,53 @@ var app = new Vue({
                 this.beep();
             }
 
+            // Every message pushes the room's inactivity deadline forward.
+            this.idleExpiresAt = Math.max(this.idleExpiresAt, Date.parse(data.timestamp) + this.idleTimeout);
+
             this.typingPeers.delete(data.data.peer_id);
-            this.messages.push({
-                type: Client.MsgType["message"],
+
+            // Encrypted messages are pushed right away to keep the order and
+            // are filled in once they're decrypted.
+            const m = {
+                id: data.data.id,
+                type: data.type,
                 timestamp: data.timestamp,
                 message: data.data.message,
+                edited: data.data.edited,
+                reactions: data.data.reactions || {},
+                replyTo: data.data.reply_to || "",
+                expiresAt: data.data.expires_at ? Date.parse(data.data.expires_at) : 0,
+                reply: data.data.reply || null,
+                peer: {
+                    id: data.data.peer_id,
+                    handle: data.data.peer_handle,
+                    avatar: this.hashColor(data.data.peer_id)
+                },
+                to: data.data.to_id ? { id: data.data.to_id, handle: data.data.to_handle } : null
+            };
+            this.messages.push(m);
+            this.decryptMessage(m, data.data.envelope);
+            this.scrollToNewester();
+            this.markRead();
+        },
+
+        onFile(data) {
+            if (!document.hasFocus()) {
+                this.newActivity = true;
+                this.beep();
+            }
+
+            this.messages.push({
+                id: data.data.id,
+                type: data.type,
+                timestamp: data.timestamp,
+                expiresAt: data.data.expires_at ? Date.parse(data.data.expires_at) : 0,
+                file: {
+                    name: data.data.name,
+                    type: data.data.type,
+                    size: data.data.size,
+                    url: data.data.url
+                },
                 peer: {
                     id: data.data.peer_id,
                     handle: data.data.peer_handle,
@@ -395,6 +1028,73 @@ var app = new Vue({
             this.scrollToNewester();
         },
 
+        onMessageRead(data) {
+            data.data.forEach(r => {
+                this.$set(this.reads, r.peer_id, r.id);
+            });
+        },
+
+        // Report the last message in the room as seen if the window is in focus.
+        // Reports are debounced as they count towards the rate limit.
+        markRead() {
+            if (!document.hasFocus() || this.readTimer) {
+                return;
+            }
+            this.readTimer = window.setTimeout(() => {
+                this.readTimer = null;
+                this.sendRead();
+            }, readDebounceInterval);
+        },
+
+        sendRead() {
+            const m = this.messages.slice().reverse().find(m => m.id && !m.to);
+            if (!m || m.id === this.lastRead) {
+                return;
+            }
+            this.lastRead = m.id;
+            Client.sendMessage(Client.MsgType["message.read"], { id: m.id });
+        },
+
+        // Handles of the peers (other than the author) who've last seen a message.
+        seenBy(m) {
+            return this.peers.filter(p => p.id !== this.self.id && p.id !== m.peer.id &&
+                this.reads[p.id] === m.id).map(p => p.handle);
+        },
+
+        // Message content to send. It's encrypted into an envelope in E2E rooms.
+        async makeContent(msg) {
+            if (!_room.e2e) {
+                return { message: msg };
+            }
+            if (!Crypto.ready()) {
+                throw "Can't send messages without the room's full link";
+            }
+            return { envelope: await Crypto.encrypt(msg) };
+        },
+
+        // Decrypt the envelope of a message in an E2E room, if there's one.
+        decryptMessage(m, env) {
+            if (!env) {
+                return;
+            }
+            Crypto.decrypt(env)
+                .then(msg => {
+                    m.message = msg;
+                })
+                .catch(() => {
+                    m.message = "[unable to decrypt message]";
+                });
+        },
+
+        // Derive the key of an E2E room from the secret in the URL fragment.
+        initCrypto() {
+            if (!window.hasOwnProperty("_room") || !_room.e2e || location.hash.length < 2) {
+                return;
+            }
+            this.secret = location.hash.substring(1);
+            Crypto.init(this.secret, _room.id);
+        },
+
         // Register chat client events.
         initClient() {
             Client.on(Client.MsgType["connect"], this.onConnect);
@@ -402,6 +1102,14 @@ var app = new Vue({
             Client.on(Client.MsgType["peer.ratelimited"], (data) => { this.onDisconnect(Client.MsgType["peer.ratelimited"]); });
             Client.on(Client.MsgType["room.dispose"], (data) => { this.onDisconnect(Client.MsgType["room.dispose"]); });
             Client.on(Client.MsgType["room.full"], (data) => { this.onDisconnect(Client.MsgType["room.full"]); });
+            Client.on(Client.MsgType["room.locked"], (data) => { this.onDisconnect(Client.MsgType["room.locked"]); });
+            ["room.lock", "room.unlock"].forEach(t => {
+                Client.on(Client.MsgType[t], (data) => { this.onRoomLock(data, Client.MsgType[t]); });
+            });
+            Client.on(Client.MsgType["room.update"], this.onRoomUpdate);
+            Client.on(Client.MsgType["room.password"], this.onRoomPassword);
+            Client.on(Client.MsgType["peer.revoked"], (data) => { this.onDisconnect(Client.MsgType["peer.revoked"]); });
+            Client.on(Client.MsgType["peer.slow"], (data) => { this.onDisconnect(Client.MsgType["peer.slow"]); });
             Client.on(Client.MsgType["reconnecting"], this.onReconnecting);
 
             Client.on(Client.MsgType["peer.info"], this.onPeerSelf);
@@ -409,7 +1117,23 @@ var app = new Vue({
             Client.on(Client.MsgType["peer.join"], (data) => { this.onPeerJoinLeave(data, Client.MsgType["peer.join"]); });
             Client.on(Client.MsgType["peer.leave"], (data) => { this.onPeerJoinLeave(data, Client.MsgType["peer.leave"]); });
             Client.on(Client.MsgType["message"], this.onMessage);
+            Client.on(Client.MsgType["message.direct"], this.onMessage);
+            Client.on(Client.MsgType["message.edit"], this.onMessageEdit);
+            Client.on(Client.MsgType["message.delete"], this.onMessageDelete);
+            Client.on(Client.MsgType["message.expire"], this.onMessageDelete);
+            Client.on(Client.MsgType["message.react"], this.onMessageReact);
+            Client.on(Client.MsgType["message.read"], this.onMessageRead);
+            Client.on(Client.MsgType["file"], this.onFile);
             Client.on(Client.MsgType["typing"], this.onTyping);
+            Client.on(Client.MsgType["peer.role"], this.onPeerRole);
+            Client.on(Client.MsgType["handle"], this.onHandle);
+            Client.on(Client.MsgType["notice"], this.onNotice);
+            ["peer.kick", "peer.ban", "peer.mute", "peer.unmute"].forEach(t => {
+                Client.on(Client.MsgType[t], (data) => { this.onPeerModerated(data, Client.MsgType[t]); });
+            });
+            Client.on(Client.MsgType["error"], this.onError);
+            Client.on(Client.MsgType["peer.warning"], this.onWarning);
+            Client.on(Client.MsgType["history.truncated"], this.onTruncated);
         },
 
         initTimers() {
@@ -428,8 +1152,30 @@ var app = new Vue({
             window.onfocus = () => {
                 this.newActivity = false;
                 document.title = this.pageTitle;
+                this.markRead();
             };
 
+            // Countdown to the room's expiry.
+            window.setInterval(() => {
+                if (!this.idleExpiresAt) {
+                    return;
+                }
+                let t = this.idleExpiresAt;
+                if (this.expiresAt && this.expiresAt < t) {
+                    t = this.expiresAt;
+                }
+                this.countdown = this.formatDuration(t - Date.now());
+            }, 1000);
+
+            // Erase expired messages. The room removes them too, but not the
+            // ones that have rolled out of its cache.
+            window.setInterval(() => {
+                this.now = Date.now();
+                if (this.messages.some(m => m.expiresAt && m.expiresAt <= this.now)) {
+                    this.messages = this.messages.filter(m => !m.expiresAt || m.expiresAt > this.now);
+                }
+            }, 1000);
+
             // Sweep "typing" statuses at regular intervals.
             window.setInterval(() => {
                 let changed = false;
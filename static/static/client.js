@@ -5,15 +5,37 @@ var Client = new function () {
 		"reconnecting": "reconnecting",
 		"room.dispose": "room.dispose",
 		"room.full": "room.full",
+		"room.lock": "room.lock",
+		"room.unlock": "room.unlock",
+		"room.locked": "room.locked",
+		"room.update": "room.update",
+		"room.password": "room.password",
+		"history.truncated": "history.truncated",
 		"message": "message",
+		"message.direct": "message.direct",
+		"message.edit": "message.edit",
+		"message.delete": "message.delete",
+		"message.react": "message.react",
+		"message.read": "message.read",
+		"message.expire": "message.expire",
 		"typing": "typing",
 		"peer.list": "peer.list",
 		"peer.info": "peer.info",
 		"peer.join": "peer.join",
 		"peer.leave": "peer.leave",
+		"peer.kick": "peer.kick",
+		"peer.ban": "peer.ban",
+		"peer.mute": "peer.mute",
+		"peer.unmute": "peer.unmute",
 		"peer.ratelimited": "peer.ratelimited",
+		"peer.warning": "peer.warning",
+		"peer.slow": "peer.slow",
+		"peer.role": "peer.role",
+		"peer.revoked": "peer.revoked",
 		"notice": "notice",
-		"handle": "handle"
+		"handle": "handle",
+		"file": "file",
+		"error": "error"
 	};
 	this.MsgType = MsgType;
 
@@ -26,7 +48,11 @@ var Client = new function () {
 		triggers = {},
 		ping_timer = null,
 		reconnect_timer = null,
-		peer = { id: null, handle: null };
+		peer = { id: null, handle: null },
+
+		// Sequence number of the last recorded payload received. It's sent
+		// on reconnection to only get the payloads that were missed.
+		lastSeq = 0;
 
 
 	// Initialize and connect the websocket.
@@ -42,7 +68,7 @@ var Client = new function () {
 
 	// websocket hooks
 	this.connect = function () {
-		ws = new WebSocket(wsURL);
+		ws = new WebSocket(lastSeq > 0 ? wsURL + "?since=" + lastSeq : wsURL);
 		ws.onopen = function () {
 			trigger(MsgType["connect"]);
 		};
@@ -54,6 +80,16 @@ var Client = new function () {
 			} catch (e) {
 				return null;
 			}
+
+			if (data.type === MsgType["history.truncated"]) {
+				lastSeq = 0;
+			} else if (data.seq) {
+				// Skip payloads that have already been received.
+				if (data.seq <= lastSeq) {
+					return;
+				}
+				lastSeq = data.seq;
+			}
 			trigger(data.type, data);
 		};
 
@@ -66,6 +102,11 @@ var Client = new function () {
 			if (e.code == 1000) {
 				if (e.reason && MsgType.hasOwnProperty(e.reason)) {
 					trigger(e.reason);
+
+					// Peers that can't keep up with the room can reconnect.
+					if (e.reason === MsgType["peer.slow"]) {
+						attemptReconnection();
+					}
 					return
 				}
 				trigger(MsgType["disconnect"]);
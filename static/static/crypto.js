@@ -0,0 +1,60 @@
+// End-to-end encryption of messages in E2E rooms. The key is derived from a
+// secret that's kept in the room URL's fragment (#secret), which browsers never
+// send to the server. The server only ever sees and relays the envelopes.
+var Crypto = new function () {
+	const version = 1,
+		nonceLen = 12,
+		iterations = 100000;
+
+	// Promise of the derived key.
+	var key = null;
+
+	// Generate a new random secret for a room.
+	this.newSecret = function () {
+		return toBase64(crypto.getRandomValues(new Uint8Array(24)))
+			.replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+	};
+
+	// Derive the room's key from the secret. The room ID is used as the salt.
+	this.init = function (secret, roomID) {
+		const enc = new TextEncoder();
+
+		key = crypto.subtle.importKey("raw", enc.encode(secret), "PBKDF2", false, ["deriveKey"])
+			.then(base => crypto.subtle.deriveKey(
+				{ name: "PBKDF2", salt: enc.encode(roomID), iterations: iterations, hash: "SHA-256" },
+				base, { name: "AES-GCM", length: 256 }, false, ["encrypt", "decrypt"]));
+		return key;
+	};
+
+	this.ready = function () {
+		return key !== null;
+	};
+
+	// Encrypt a message into an envelope.
+	this.encrypt = async function (text) {
+		const nonce = crypto.getRandomValues(new Uint8Array(nonceLen)),
+			ct = await crypto.subtle.encrypt({ name: "AES-GCM", iv: nonce }, await key, new TextEncoder().encode(text));
+
+		return { v: version, nonce: toBase64(nonce), ciphertext: toBase64(new Uint8Array(ct)) };
+	};
+
+	// Decrypt an envelope into a message. It throws if the envelope can't be
+	// decrypted (eg: a wrong secret).
+	this.decrypt = async function (env) {
+		if (!key || !env || env.v !== version) {
+			throw new Error("can't decrypt message");
+		}
+
+		const b = await crypto.subtle.decrypt({ name: "AES-GCM", iv: fromBase64(env.nonce) }, await key, fromBase64(env.ciphertext));
+		return new TextDecoder().decode(b);
+	};
+
+	// ___ private
+	function toBase64(b) {
+		return btoa(String.fromCharCode.apply(null, b));
+	}
+
+	function fromBase64(s) {
+		return Uint8Array.from(atob(s), c => c.charCodeAt(0));
+	}
+};
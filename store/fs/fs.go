@@ -29,8 +29,45 @@ type File struct {
 
 type room struct {
 	store.Room
-	Sessions map[string]string
+	Sessions sessions
 	Expire   time.Time
+
+	// Banned handles and IPs (prefixed with "handle:" and "ip:") and
+	// the time until which they're banned.
+	Bans map[string]time.Time
+
+	// Message payloads, if the history is persisted.
+	History []store.Payload
+
+	// Invites to the room by their IDs.
+	Invites map[string]store.Invite
+}
+
+// sessions are the peer sessions in a room by their IDs.
+type sessions map[string]store.Sess
+
+// UnmarshalJSON decodes sessions, including the ones saved by older versions
+// which only hold the handle.
+func (s *sessions) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	out := make(sessions, len(raw))
+	for id, v := range raw {
+		var sess store.Sess
+		if err := json.Unmarshal(v, &sess); err != nil {
+			var handle string
+			if err := json.Unmarshal(v, &handle); err != nil {
+				return err
+			}
+			sess = store.Sess{ID: id, Handle: handle}
+		}
+		out[id] = sess
+	}
+	*s = out
+	return nil
 }
 
 // New returns a new Redis store.
@@ -74,7 +111,7 @@ func (m *File) cleanup() {
 
 // load the data from the file system.
 func (m *File) load() error {
-	if _, err := os.Stat(m.cfg.Path); os.IsExist(err) {
+	if _, err := os.Stat(m.cfg.Path); err == nil {
 		x := struct {
 			Rooms map[string]*room
 			Data  map[string][]byte
@@ -127,7 +164,8 @@ func (m *File) AddRoom(r store.Room, ttl time.Duration) error {
 	m.rooms[key] = &room{
 		Room:     r,
 		Expire:   r.CreatedAt.Add(ttl),
-		Sessions: map[string]string{},
+		Sessions: sessions{},
+		Bans:     map[string]time.Time{},
 	}
 	m.dirty = true
 
@@ -163,6 +201,20 @@ func (m *File) GetRoom(id string) (store.Room, error) {
 	return out.Room, nil
 }
 
+// UpdateRoom updates the properties of a room in the store.
+func (m *File) UpdateRoom(r store.Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[r.ID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	room.Room = r
+	m.dirty = true
+	return nil
+}
+
 // RoomExists checks if a room exists in the store.
 func (m *File) RoomExists(id string) (bool, error) {
 	m.mu.Lock()
@@ -173,6 +225,23 @@ func (m *File) RoomExists(id string) (bool, error) {
 	return ok, nil
 }
 
+// CountRooms returns the number of unexpired rooms in the store.
+func (m *File) CountRooms() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var (
+		n   = 0
+		now = time.Now()
+	)
+	for _, r := range m.rooms {
+		if r.Expire.After(now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
 // RemoveRoom deletes a room from the store.
 func (m *File) RemoveRoom(id string) error {
 	m.mu.Lock()
@@ -187,7 +256,7 @@ func (m *File) RemoveRoom(id string) error {
 }
 
 // AddSession adds a sessionID room to the store.
-func (m *File) AddSession(sessID, handle, roomID string, ttl time.Duration) error {
+func (m *File) AddSession(s store.Sess, roomID string, ttl time.Duration) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -197,7 +266,7 @@ func (m *File) AddSession(sessID, handle, roomID string, ttl time.Duration) erro
 		return store.ErrRoomNotFound
 	}
 
-	room.Sessions[sessID] = handle
+	room.Sessions[s.ID] = s
 	m.rooms[roomID] = room
 	m.dirty = true
 
@@ -215,16 +284,32 @@ func (m *File) GetSession(sessID, roomID string) (store.Sess, error) {
 		return store.Sess{}, store.ErrRoomNotFound
 	}
 
-	handle, ok := room.Sessions[sessID]
+	s, ok := room.Sessions[sessID]
 
 	if !ok {
 		return store.Sess{}, nil
 	}
 
-	return store.Sess{
-		ID:     sessID,
-		Handle: handle,
-	}, nil
+	return s, nil
+}
+
+// UpdateSession updates an existing peer session in a room.
+func (m *File) UpdateSession(s store.Sess, roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	if _, ok := room.Sessions[s.ID]; ok {
+		room.Sessions[s.ID] = s
+		m.dirty = true
+	}
+
+	return nil
 }
 
 // RemoveSession deletes a session ID from a room.
@@ -247,6 +332,27 @@ func (m *File) RemoveSession(sessID, roomID string) error {
 	return nil
 }
 
+// RemoveSessionsExcept deletes all the sessions in a room but the given one.
+func (m *File) RemoveSessionsExcept(sessID, roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	for id := range room.Sessions {
+		if id != sessID {
+			delete(room.Sessions, id)
+			m.dirty = true
+		}
+	}
+
+	return nil
+}
+
 // ClearSessions deletes all the sessions in a room.
 func (m *File) ClearSessions(roomID string) error {
 	m.mu.Lock()
@@ -258,7 +364,7 @@ func (m *File) ClearSessions(roomID string) error {
 		return store.ErrRoomNotFound
 	}
 
-	room.Sessions = map[string]string{}
+	room.Sessions = sessions{}
 
 	m.rooms[roomID] = room
 	m.dirty = true
@@ -266,6 +372,229 @@ func (m *File) ClearSessions(roomID string) error {
 	return nil
 }
 
+// BanPeer bans a handle and an IP from a room for the given duration.
+func (m *File) BanPeer(roomID, handle, ip string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	if room.Bans == nil {
+		room.Bans = map[string]time.Time{}
+	}
+
+	until := time.Now().Add(ttl)
+	if handle != "" {
+		room.Bans["handle:"+handle] = until
+	}
+	if ip != "" {
+		room.Bans["ip:"+ip] = until
+	}
+	m.dirty = true
+
+	return nil
+}
+
+// IsBanned checks whether a handle or an IP is banned from a room.
+func (m *File) IsBanned(roomID, handle, ip string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return false, store.ErrRoomNotFound
+	}
+
+	now := time.Now()
+	for _, k := range []string{"handle:" + handle, "ip:" + ip} {
+		if t, ok := room.Bans[k]; ok && t.After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AppendHistory appends a payload to a room's history.
+func (m *File) AppendHistory(roomID string, p store.Payload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	room.History = append(room.History, p)
+	m.dirty = true
+	return nil
+}
+
+// GetHistory returns the payloads in a room's history after the given
+// sequence number.
+func (m *File) GetHistory(roomID string, since uint64) ([]store.Payload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return nil, store.ErrRoomNotFound
+	}
+
+	out := []store.Payload{}
+	for _, p := range room.History {
+		if p.Seq > since {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// UpdateHistory replaces a payload in a room's history.
+func (m *File) UpdateHistory(roomID string, p store.Payload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	for n, h := range room.History {
+		if h.Seq == p.Seq {
+			room.History[n] = p
+			m.dirty = true
+			break
+		}
+	}
+	return nil
+}
+
+// RemoveHistory removes a payload from a room's history.
+func (m *File) RemoveHistory(roomID string, seq uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	for n, h := range room.History {
+		if h.Seq == seq {
+			room.History = append(room.History[:n], room.History[n+1:]...)
+			m.dirty = true
+			break
+		}
+	}
+	return nil
+}
+
+// TrimHistory trims a room's history to its last n payloads.
+func (m *File) TrimHistory(roomID string, n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	if len(room.History) > n {
+		room.History = append([]store.Payload{}, room.History[len(room.History)-n:]...)
+		m.dirty = true
+	}
+	return nil
+}
+
+// AddInvite adds an invite to a room.
+func (m *File) AddInvite(roomID string, inv store.Invite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	if room.Invites == nil {
+		room.Invites = map[string]store.Invite{}
+	}
+	room.Invites[inv.ID] = inv
+	m.dirty = true
+	return nil
+}
+
+// GetInvites returns the unexpired invites to a room.
+func (m *File) GetInvites(roomID string) ([]store.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return nil, store.ErrRoomNotFound
+	}
+
+	out := []store.Invite{}
+	for _, inv := range room.Invites {
+		if time.Now().Before(inv.ExpiresAt) {
+			out = append(out, inv)
+		}
+	}
+	return out, nil
+}
+
+// UseInvite counts a use of an invite to a room if it's still valid.
+func (m *File) UseInvite(roomID, id string) (store.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.Invite{}, store.ErrRoomNotFound
+	}
+
+	inv, ok := room.Invites[id]
+	if !ok || !inv.Valid() {
+		return store.Invite{}, store.ErrInviteNotFound
+	}
+	inv.Uses++
+	room.Invites[id] = inv
+	m.dirty = true
+	return inv, nil
+}
+
+// RemoveInvite deletes an invite to a room.
+func (m *File) RemoveInvite(roomID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	if _, ok := room.Invites[id]; !ok {
+		return store.ErrInviteNotFound
+	}
+	delete(room.Invites, id)
+	m.dirty = true
+	return nil
+}
+
 // Get value from a key.
 func (m *File) Get(key string) ([]byte, error) {
 	m.mu.Lock()
@@ -21,8 +21,18 @@ type InMemory struct {
 
 type room struct {
 	store.Room
-	Sessions map[string]string
+	Sessions map[string]store.Sess
 	Expire   time.Time
+
+	// Banned handles and IPs (prefixed with "handle:" and "ip:") and
+	// the time until which they're banned.
+	Bans map[string]time.Time
+
+	// Message payloads, if the history is persisted.
+	History []store.Payload
+
+	// Invites to the room by their IDs.
+	Invites map[string]store.Invite
 }
 
 // New returns a new Redis store.
@@ -68,7 +78,8 @@ func (m *InMemory) AddRoom(r store.Room, ttl time.Duration) error {
 	m.rooms[r.ID] = &room{
 		Room:     r,
 		Expire:   r.CreatedAt.Add(ttl),
-		Sessions: map[string]string{},
+		Sessions: map[string]store.Sess{},
+		Bans:     map[string]time.Time{},
 	}
 
 	return nil
@@ -102,6 +113,19 @@ func (m *InMemory) GetRoom(id string) (store.Room, error) {
 	return out.Room, nil
 }
 
+// UpdateRoom updates the properties of a room in the store.
+func (m *InMemory) UpdateRoom(r store.Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[r.ID]
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+	room.Room = r
+	return nil
+}
+
 // RoomExists checks if a room exists in the store.
 func (m *InMemory) RoomExists(id string) (bool, error) {
 	m.mu.Lock()
@@ -112,6 +136,23 @@ func (m *InMemory) RoomExists(id string) (bool, error) {
 	return ok, nil
 }
 
+// CountRooms returns the number of unexpired rooms in the store.
+func (m *InMemory) CountRooms() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var (
+		n   = 0
+		now = time.Now()
+	)
+	for _, r := range m.rooms {
+		if r.Expire.After(now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
 // RemoveRoom deletes a room from the store.
 func (m *InMemory) RemoveRoom(id string) error {
 	m.mu.Lock()
@@ -123,7 +164,7 @@ func (m *InMemory) RemoveRoom(id string) error {
 }
 
 // AddSession adds a sessionID room to the store.
-func (m *InMemory) AddSession(sessID, handle, roomID string, ttl time.Duration) error {
+func (m *InMemory) AddSession(s store.Sess, roomID string, ttl time.Duration) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -133,7 +174,7 @@ func (m *InMemory) AddSession(sessID, handle, roomID string, ttl time.Duration)
 		return store.ErrRoomNotFound
 	}
 
-	room.Sessions[sessID] = handle
+	room.Sessions[s.ID] = s
 	m.rooms[roomID] = room
 
 	return nil
@@ -150,16 +191,31 @@ func (m *InMemory) GetSession(sessID, roomID string) (store.Sess, error) {
 		return store.Sess{}, store.ErrRoomNotFound
 	}
 
-	handle, ok := room.Sessions[sessID]
+	s, ok := room.Sessions[sessID]
 
 	if !ok {
 		return store.Sess{}, nil
 	}
 
-	return store.Sess{
-		ID:     sessID,
-		Handle: handle,
-	}, nil
+	return s, nil
+}
+
+// UpdateSession updates an existing peer session in a room.
+func (m *InMemory) UpdateSession(s store.Sess, roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	if _, ok := room.Sessions[s.ID]; ok {
+		room.Sessions[s.ID] = s
+	}
+
+	return nil
 }
 
 // RemoveSession deletes a session ID from a room.
@@ -179,6 +235,26 @@ func (m *InMemory) RemoveSession(sessID, roomID string) error {
 	return nil
 }
 
+// RemoveSessionsExcept deletes all the sessions in a room but the given one.
+func (m *InMemory) RemoveSessionsExcept(sessID, roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	for id := range room.Sessions {
+		if id != sessID {
+			delete(room.Sessions, id)
+		}
+	}
+
+	return nil
+}
+
 // ClearSessions deletes all the sessions in a room.
 func (m *InMemory) ClearSessions(roomID string) error {
 	m.mu.Lock()
@@ -190,13 +266,228 @@ func (m *InMemory) ClearSessions(roomID string) error {
 		return store.ErrRoomNotFound
 	}
 
-	room.Sessions = map[string]string{}
+	room.Sessions = map[string]store.Sess{}
 
 	m.rooms[roomID] = room
 
 	return nil
 }
 
+// BanPeer bans a handle and an IP from a room for the given duration.
+func (m *InMemory) BanPeer(roomID, handle, ip string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	if room.Bans == nil {
+		room.Bans = map[string]time.Time{}
+	}
+
+	until := time.Now().Add(ttl)
+	if handle != "" {
+		room.Bans["handle:"+handle] = until
+	}
+	if ip != "" {
+		room.Bans["ip:"+ip] = until
+	}
+
+	return nil
+}
+
+// IsBanned checks whether a handle or an IP is banned from a room.
+func (m *InMemory) IsBanned(roomID, handle, ip string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return false, store.ErrRoomNotFound
+	}
+
+	now := time.Now()
+	for _, k := range []string{"handle:" + handle, "ip:" + ip} {
+		if t, ok := room.Bans[k]; ok && t.After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AppendHistory appends a payload to a room's history.
+func (m *InMemory) AppendHistory(roomID string, p store.Payload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	room.History = append(room.History, p)
+	return nil
+}
+
+// GetHistory returns the payloads in a room's history after the given
+// sequence number.
+func (m *InMemory) GetHistory(roomID string, since uint64) ([]store.Payload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return nil, store.ErrRoomNotFound
+	}
+
+	out := []store.Payload{}
+	for _, p := range room.History {
+		if p.Seq > since {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// UpdateHistory replaces a payload in a room's history.
+func (m *InMemory) UpdateHistory(roomID string, p store.Payload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	for n, h := range room.History {
+		if h.Seq == p.Seq {
+			room.History[n] = p
+			break
+		}
+	}
+	return nil
+}
+
+// RemoveHistory removes a payload from a room's history.
+func (m *InMemory) RemoveHistory(roomID string, seq uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	for n, h := range room.History {
+		if h.Seq == seq {
+			room.History = append(room.History[:n], room.History[n+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// TrimHistory trims a room's history to its last n payloads.
+func (m *InMemory) TrimHistory(roomID string, n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	if len(room.History) > n {
+		room.History = append([]store.Payload{}, room.History[len(room.History)-n:]...)
+	}
+	return nil
+}
+
+// AddInvite adds an invite to a room.
+func (m *InMemory) AddInvite(roomID string, inv store.Invite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	if room.Invites == nil {
+		room.Invites = map[string]store.Invite{}
+	}
+	room.Invites[inv.ID] = inv
+	return nil
+}
+
+// GetInvites returns the unexpired invites to a room.
+func (m *InMemory) GetInvites(roomID string) ([]store.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return nil, store.ErrRoomNotFound
+	}
+
+	out := []store.Invite{}
+	for _, inv := range room.Invites {
+		if time.Now().Before(inv.ExpiresAt) {
+			out = append(out, inv)
+		}
+	}
+	return out, nil
+}
+
+// UseInvite counts a use of an invite to a room if it's still valid.
+func (m *InMemory) UseInvite(roomID, id string) (store.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.Invite{}, store.ErrRoomNotFound
+	}
+
+	inv, ok := room.Invites[id]
+	if !ok || !inv.Valid() {
+		return store.Invite{}, store.ErrInviteNotFound
+	}
+	inv.Uses++
+	room.Invites[id] = inv
+	return inv, nil
+}
+
+// RemoveInvite deletes an invite to a room.
+func (m *InMemory) RemoveInvite(roomID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	if _, ok := room.Invites[id]; !ok {
+		return store.ErrInviteNotFound
+	}
+	delete(room.Invites, id)
+	return nil
+}
+
 // Get value from a key.
 func (m *InMemory) Get(key string) ([]byte, error) {
 	m.mu.Lock()
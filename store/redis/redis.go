@@ -1,7 +1,10 @@
 package redis
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -19,6 +22,12 @@ type Config struct {
 
 	PrefixRoom    string `koanf:"prefix_room"`
 	PrefixSession string `koanf:"prefix_session"`
+	PrefixBan     string `koanf:"prefix_ban"`
+	PrefixHistory string `koanf:"prefix_history"`
+	PrefixInvite  string `koanf:"prefix_invite"`
+
+	// Sorted set of room IDs by their expiry that rooms are counted with.
+	KeyRooms string `koanf:"key_rooms"`
 }
 
 // Redis represents the Redis implementation of the Store interface.
@@ -32,10 +41,40 @@ type room struct {
 	Name      string `redis:"name"`
 	Password  []byte `redis:"password"`
 	CreatedAt string `redis:"created_at"`
+	E2E       bool   `redis:"e2e"`
+
+	// Message TTL in seconds.
+	MessageTTL int `redis:"message_ttl"`
+
+	Locked   bool   `redis:"locked"`
+	LockedAt string `redis:"locked_at"`
+
+	Topic       string `redis:"topic"`
+	Description string `redis:"description"`
+	Public      bool   `redis:"public"`
+
+	// Comma separated tags.
+	Tags string `redis:"tags"`
+
+	// JSON encoded settings.
+	Settings []byte `redis:"settings"`
 }
 
 // New returns a new Redis store.
 func New(cfg Config) (*Redis, error) {
+	if cfg.PrefixBan == "" {
+		cfg.PrefixBan = "NIL:BAN:ROOM:%s:%s"
+	}
+	if cfg.PrefixHistory == "" {
+		cfg.PrefixHistory = "NIL:HISTORY:ROOM:%s"
+	}
+	if cfg.PrefixInvite == "" {
+		cfg.PrefixInvite = "NIL:INVITE:ROOM:%s"
+	}
+	if cfg.KeyRooms == "" {
+		cfg.KeyRooms = "NIL:ROOMS"
+	}
+
 	pool := &redis.Pool{
 		Wait:      true,
 		MaxActive: cfg.ActiveConns,
@@ -69,25 +108,47 @@ func (r *Redis) AddRoom(room store.Room, ttl time.Duration) error {
 	defer c.Close()
 
 	key := fmt.Sprintf(r.cfg.PrefixRoom, room.ID)
-	c.Send("HMSET", key,
-		"name", room.Name,
-		"created_at", room.CreatedAt.Format(time.RFC3339),
-		"password", room.Password)
+	c.Send("HMSET", r.roomFields(key, room)...)
 	c.Send("EXPIRE", key, int(ttl.Seconds()))
+	c.Send("ZADD", r.cfg.KeyRooms, time.Now().Add(ttl).Unix(), room.ID)
 	return c.Flush()
 }
 
-// ExtendRoomTTL extends a room's TTL.
+// UpdateRoom updates the properties of a room in the store without altering
+// its TTL.
+func (r *Redis) UpdateRoom(room store.Room) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixRoom, room.ID)
+	ok, err := redis.Bool(c.Do("EXISTS", key))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	_, err = c.Do("HMSET", r.roomFields(key, room)...)
+	return err
+}
+
+// ExtendRoomTTL extends a room's TTL. The room is (re)indexed for counting
+// as rooms stored before the index existed aren't in it.
 func (r *Redis) ExtendRoomTTL(id string, ttl time.Duration) error {
 	c := r.pool.Get()
 	defer c.Close()
 
 	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixRoom, id), int(ttl.Seconds()))
 	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixSession, id), int(ttl.Seconds()))
+	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixHistory, id), int(ttl.Seconds()))
+	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixInvite, id), int(ttl.Seconds()))
+	c.Send("ZADD", r.cfg.KeyRooms, time.Now().Add(ttl).Unix(), id)
 	return c.Flush()
 }
 
-// GetRoom gets a room from the store.
+// GetRoom gets a room from the store. A room that isn't indexed for counting
+// (eg: stored before the index existed) is indexed by its current TTL.
 func (r *Redis) GetRoom(id string) (store.Room, error) {
 	c := r.pool.Get()
 	defer c.Close()
@@ -112,14 +173,81 @@ func (r *Redis) GetRoom(id string) (store.Room, error) {
 	if t.Year() == 1 {
 		return out, store.ErrRoomNotFound
 	}
+
+	ttl, err := redis.Int(c.Do("TTL", key))
+	if err != nil {
+		return out, err
+	}
+	if ttl > 0 {
+		if _, err := c.Do("ZADD", r.cfg.KeyRooms, "NX", time.Now().Unix()+int64(ttl), id); err != nil {
+			return out, err
+		}
+	}
+
+	var lockedAt time.Time
+	if room.LockedAt != "" {
+		lockedAt, _ = time.Parse(time.RFC3339Nano, room.LockedAt)
+	}
+
+	var tags []string
+	if room.Tags != "" {
+		tags = strings.Split(room.Tags, ",")
+	}
+
+	var settings *store.RoomSettings
+	if len(room.Settings) > 0 {
+		settings = &store.RoomSettings{}
+		if err := json.Unmarshal(room.Settings, settings); err != nil {
+			return out, err
+		}
+	}
+
 	return store.Room{
-		ID:        id,
-		Name:      room.Name,
-		Password:  room.Password,
-		CreatedAt: t,
+		ID:         id,
+		Name:       room.Name,
+		Password:   room.Password,
+		CreatedAt:  t,
+		E2E:        room.E2E,
+		MessageTTL: time.Duration(room.MessageTTL) * time.Second,
+		Locked:     room.Locked,
+		LockedAt:   lockedAt,
+
+		Topic:       room.Topic,
+		Description: room.Description,
+		Public:      room.Public,
+		Tags:        tags,
+		Settings:    settings,
 	}, nil
 }
 
+// roomFields returns the arguments to HMSET a room's properties in a hash.
+func (r *Redis) roomFields(key string, room store.Room) []any {
+	lockedAt := ""
+	if !room.LockedAt.IsZero() {
+		lockedAt = room.LockedAt.Format(time.RFC3339Nano)
+	}
+
+	var settings []byte
+	if room.Settings != nil {
+		settings, _ = json.Marshal(room.Settings)
+	}
+
+	return []any{key,
+		"name", room.Name,
+		"created_at", room.CreatedAt.Format(time.RFC3339),
+		"password", room.Password,
+		"e2e", room.E2E,
+		"message_ttl", int(room.MessageTTL.Seconds()),
+		"locked", room.Locked,
+		"locked_at", lockedAt,
+		"topic", room.Topic,
+		"description", room.Description,
+		"public", room.Public,
+		"tags", strings.Join(room.Tags, ","),
+		"settings", settings,
+	}
+}
+
 // RoomExists checks if a room exists in the store.
 func (r *Redis) RoomExists(id string) (bool, error) {
 	c := r.pool.Get()
@@ -132,23 +260,41 @@ func (r *Redis) RoomExists(id string) (bool, error) {
 	return ok, err
 }
 
+// CountRooms returns the number of rooms in the store. Rooms are indexed by
+// their expiry in a sorted set, from which the expired ones are dropped
+// before counting.
+func (r *Redis) CountRooms() (int, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	c.Send("ZREMRANGEBYSCORE", r.cfg.KeyRooms, "-inf", time.Now().Unix())
+	return redis.Int(c.Do("ZCARD", r.cfg.KeyRooms))
+}
+
 // RemoveRoom deletes a room from the store.
 func (r *Redis) RemoveRoom(id string) error {
 	c := r.pool.Get()
 	defer c.Close()
 
-	_, err := redis.Bool(c.Do("DEL", fmt.Sprintf(r.cfg.PrefixRoom, id)))
+	c.Send("ZREM", r.cfg.KeyRooms, id)
+	_, err := redis.Bool(c.Do("DEL", fmt.Sprintf(r.cfg.PrefixRoom, id),
+		fmt.Sprintf(r.cfg.PrefixHistory, id), fmt.Sprintf(r.cfg.PrefixInvite, id)))
 	return err
 }
 
 // AddSession adds a sessionID room to the store.
-func (r *Redis) AddSession(sessID, handle, roomID string, ttl time.Duration) error {
+func (r *Redis) AddSession(s store.Sess, roomID string, ttl time.Duration) error {
 	c := r.pool.Get()
 	defer c.Close()
 
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
 	key := fmt.Sprintf(r.cfg.PrefixSession, roomID)
-	c.Send("HMSET", key, sessID, handle)
-	c.Send("EXPIRE", key, ttl.Seconds)
+	c.Send("HMSET", key, s.ID, b)
+	c.Send("EXPIRE", key, int(ttl.Seconds()))
 	return c.Flush()
 }
 
@@ -157,18 +303,39 @@ func (r *Redis) GetSession(sessID, roomID string) (store.Sess, error) {
 	c := r.pool.Get()
 	defer c.Close()
 
-	h, err := redis.String(c.Do("HGET", fmt.Sprintf(r.cfg.PrefixSession, roomID), sessID))
+	b, err := redis.Bytes(c.Do("HGET", fmt.Sprintf(r.cfg.PrefixSession, roomID), sessID))
 	if err != nil && err != redis.ErrNil {
 		return store.Sess{}, err
 	}
-	if h == "" {
+	if len(b) == 0 {
 		return store.Sess{}, nil
 	}
 
-	return store.Sess{
-		ID:     sessID,
-		Handle: h,
-	}, nil
+	var s store.Sess
+	if err := json.Unmarshal(b, &s); err != nil {
+		// Sessions created by older versions only hold the handle.
+		return store.Sess{ID: sessID, Handle: string(b)}, nil
+	}
+	return s, nil
+}
+
+// UpdateSession updates an existing peer session in a room.
+func (r *Redis) UpdateSession(s store.Sess, roomID string) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf(r.cfg.PrefixSession, roomID)
+	ok, err := redis.Bool(c.Do("HEXISTS", key, s.ID))
+	if err != nil || !ok {
+		return err
+	}
+	_, err = c.Do("HSET", key, s.ID, b)
+	return err
 }
 
 // RemoveSession deletes a session ID from a room.
@@ -180,6 +347,32 @@ func (r *Redis) RemoveSession(sessID, roomID string) error {
 	return err
 }
 
+// RemoveSessionsExcept deletes all the sessions in a room but the given one.
+// The TTL of the room's sessions is left as it is.
+func (r *Redis) RemoveSessionsExcept(sessID, roomID string) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixSession, roomID)
+	ids, err := redis.Strings(c.Do("HKEYS", key))
+	if err != nil {
+		return err
+	}
+
+	args := redis.Args{}.Add(key)
+	for _, id := range ids {
+		if id != sessID {
+			args = args.Add(id)
+		}
+	}
+	if len(args) == 1 {
+		return nil
+	}
+
+	_, err = c.Do("HDEL", args...)
+	return err
+}
+
 // ClearSessions deletes all the sessions in a room.
 func (r *Redis) ClearSessions(roomID string) error {
 	c := r.pool.Get()
@@ -189,6 +382,233 @@ func (r *Redis) ClearSessions(roomID string) error {
 	return err
 }
 
+// BanPeer bans a handle and an IP from a room for the given duration.
+func (r *Redis) BanPeer(roomID, handle, ip string, ttl time.Duration) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	if handle != "" {
+		c.Send("SET", fmt.Sprintf(r.cfg.PrefixBan, roomID, "handle:"+handle), 1, "EX", int(ttl.Seconds()))
+	}
+	if ip != "" {
+		c.Send("SET", fmt.Sprintf(r.cfg.PrefixBan, roomID, "ip:"+ip), 1, "EX", int(ttl.Seconds()))
+	}
+	return c.Flush()
+}
+
+// IsBanned checks whether a handle or an IP is banned from a room.
+func (r *Redis) IsBanned(roomID, handle, ip string) (bool, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	n, err := redis.Int(c.Do("EXISTS",
+		fmt.Sprintf(r.cfg.PrefixBan, roomID, "handle:"+handle),
+		fmt.Sprintf(r.cfg.PrefixBan, roomID, "ip:"+ip)))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// AppendHistory appends a payload to a room's history. The history is a
+// sorted set scored by sequence numbers that expires along with the room.
+func (r *Redis) AppendHistory(roomID string, p store.Payload) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	ttl, err := redis.Int(c.Do("PTTL", fmt.Sprintf(r.cfg.PrefixRoom, roomID)))
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return store.ErrRoomNotFound
+	}
+
+	key := fmt.Sprintf(r.cfg.PrefixHistory, roomID)
+	c.Send("ZADD", key, p.Seq, b)
+	c.Send("PEXPIRE", key, ttl)
+	return c.Flush()
+}
+
+// GetHistory returns the payloads in a room's history after the given
+// sequence number.
+func (r *Redis) GetHistory(roomID string, since uint64) ([]store.Payload, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	res, err := redis.ByteSlices(c.Do("ZRANGEBYSCORE",
+		fmt.Sprintf(r.cfg.PrefixHistory, roomID), fmt.Sprintf("(%d", since), "+inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]store.Payload, 0, len(res))
+	for _, b := range res {
+		var p store.Payload
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// UpdateHistory replaces a payload in a room's history.
+func (r *Redis) UpdateHistory(roomID string, p store.Payload) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf(r.cfg.PrefixHistory, roomID)
+	c.Send("MULTI")
+	c.Send("ZREMRANGEBYSCORE", key, p.Seq, p.Seq)
+	c.Send("ZADD", key, p.Seq, b)
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// RemoveHistory removes a payload from a room's history.
+func (r *Redis) RemoveHistory(roomID string, seq uint64) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("ZREMRANGEBYSCORE", fmt.Sprintf(r.cfg.PrefixHistory, roomID), seq, seq)
+	return err
+}
+
+// TrimHistory trims a room's history to its last n payloads.
+func (r *Redis) TrimHistory(roomID string, n int) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("ZREMRANGEBYRANK", fmt.Sprintf(r.cfg.PrefixHistory, roomID), 0, -n-1)
+	return err
+}
+
+// AddInvite adds an invite to a room. The invites are kept in a hash that
+// expires along with the room.
+func (r *Redis) AddInvite(roomID string, inv store.Invite) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+
+	ttl, err := redis.Int(c.Do("PTTL", fmt.Sprintf(r.cfg.PrefixRoom, roomID)))
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return store.ErrRoomNotFound
+	}
+
+	key := fmt.Sprintf(r.cfg.PrefixInvite, roomID)
+	c.Send("HSET", key, inv.ID, b)
+	c.Send("PEXPIRE", key, ttl)
+	return c.Flush()
+}
+
+// GetInvites returns the unexpired invites to a room.
+func (r *Redis) GetInvites(roomID string) ([]store.Invite, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	res, err := redis.ByteSlices(c.Do("HVALS", fmt.Sprintf(r.cfg.PrefixInvite, roomID)))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]store.Invite, 0, len(res))
+	for _, b := range res {
+		var inv store.Invite
+		if err := json.Unmarshal(b, &inv); err != nil {
+			return nil, err
+		}
+		if time.Now().Before(inv.ExpiresAt) {
+			out = append(out, inv)
+		}
+	}
+	return out, nil
+}
+
+// UseInvite counts a use of an invite to a room if it's still valid. The
+// invite is watched so that concurrent uses can't exceed its maximum uses.
+func (r *Redis) UseInvite(roomID, id string) (store.Invite, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixInvite, roomID)
+	for i := 0; i < 5; i++ {
+		if _, err := c.Do("WATCH", key); err != nil {
+			return store.Invite{}, err
+		}
+
+		b, err := redis.Bytes(c.Do("HGET", key, id))
+		if err != nil {
+			c.Do("UNWATCH")
+			if err == redis.ErrNil {
+				return store.Invite{}, store.ErrInviteNotFound
+			}
+			return store.Invite{}, err
+		}
+
+		var inv store.Invite
+		if err := json.Unmarshal(b, &inv); err != nil {
+			c.Do("UNWATCH")
+			return store.Invite{}, err
+		}
+		if !inv.Valid() {
+			c.Do("UNWATCH")
+			return store.Invite{}, store.ErrInviteNotFound
+		}
+
+		inv.Uses++
+		if b, err = json.Marshal(inv); err != nil {
+			c.Do("UNWATCH")
+			return store.Invite{}, err
+		}
+
+		c.Send("MULTI")
+		c.Send("HSET", key, id, b)
+		res, err := c.Do("EXEC")
+		if err != nil {
+			return store.Invite{}, err
+		}
+
+		// The transaction is aborted if the invite changed in the meantime.
+		if res != nil {
+			return inv, nil
+		}
+	}
+	return store.Invite{}, errors.New("error using invite")
+}
+
+// RemoveInvite deletes an invite to a room.
+func (r *Redis) RemoveInvite(roomID, id string) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	n, err := redis.Int(c.Do("HDEL", fmt.Sprintf(r.cfg.PrefixInvite, roomID), id))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return store.ErrInviteNotFound
+	}
+	return nil
+}
+
 // Get value from a key.
 func (r *Redis) Get(key string) ([]byte, error) {
 	c := r.pool.Get()
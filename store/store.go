@@ -9,14 +9,32 @@ import (
 type Store interface {
 	AddRoom(r Room, ttl time.Duration) error
 	GetRoom(id string) (Room, error)
+	UpdateRoom(r Room) error
 	ExtendRoomTTL(id string, ttl time.Duration) error
 	RoomExists(id string) (bool, error)
+	CountRooms() (int, error)
 	RemoveRoom(id string) error
 
-	AddSession(sessID, handle, roomID string, ttl time.Duration) error
+	AddSession(s Sess, roomID string, ttl time.Duration) error
 	GetSession(sessID, roomID string) (Sess, error)
+	UpdateSession(s Sess, roomID string) error
 	RemoveSession(sessID, roomID string) error
 	ClearSessions(roomID string) error
+	RemoveSessionsExcept(sessID, roomID string) error
+
+	BanPeer(roomID, handle, ip string, ttl time.Duration) error
+	IsBanned(roomID, handle, ip string) (bool, error)
+
+	AppendHistory(roomID string, p Payload) error
+	GetHistory(roomID string, since uint64) ([]Payload, error)
+	UpdateHistory(roomID string, p Payload) error
+	RemoveHistory(roomID string, seq uint64) error
+	TrimHistory(roomID string, n int) error
+
+	AddInvite(roomID string, inv Invite) error
+	GetInvites(roomID string) ([]Invite, error)
+	UseInvite(roomID, id string) (Invite, error)
+	RemoveInvite(roomID, id string) error
 
 	Get(key string) ([]byte, error)
 	Set(key string, value []byte) error
@@ -28,13 +46,82 @@ type Room struct {
 	Name      string    `json:"name"`
 	Password  []byte    `json:"password"`
 	CreatedAt time.Time `json:"created_at"`
+
+	// Messages in end-to-end encrypted rooms are only relayed as ciphertext.
+	E2E bool `json:"e2e"`
+
+	// Default expiry of the messages in the room, if any.
+	MessageTTL time.Duration `json:"message_ttl"`
+
+	// Locked rooms don't admit new peers. Only the peers whose sessions
+	// were created before the room was locked can join.
+	Locked   bool      `json:"locked"`
+	LockedAt time.Time `json:"locked_at"`
+
+	// Topic and description of the room, which can be changed later along
+	// with its name.
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+
+	// Public rooms have no password and are listed in the room directory
+	// along with their tags.
+	Public bool     `json:"public"`
+	Tags   []string `json:"tags"`
+
+	// Limits of the room chosen when it's created. Rooms created by older
+	// versions don't have any and get the app's defaults.
+	Settings *RoomSettings `json:"settings,omitempty"`
+}
+
+// RoomSettings represents the limits of a room that override the app's
+// defaults (max_peers_per_room, max_cached_messages etc.).
+type RoomSettings struct {
+	MaxPeers          int           `json:"max_peers"`
+	MaxCachedMessages int           `json:"max_cached_messages"`
+	MaxMessageLen     int           `json:"max_message_length"`
+	RateLimitMessages int           `json:"rate_limit_messages"`
+	RateLimitInterval time.Duration `json:"rate_limit_interval"`
+	RoomAge           time.Duration `json:"room_age"`
 }
 
-// Sess represents an authenticated peer session.
+// Sess represents an authenticated peer session. ID is the session secret
+// that's never shared with other peers, who only see PeerID.
 type Sess struct {
 	ID     string `json:"id"`
+	PeerID string `json:"peer_id"`
 	Handle string `json:"name"`
+	Role   string `json:"role"`
+	Muted  bool   `json:"muted"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Payload represents a message payload in a room's history, ordered by its
+// sequence number. A room's history expires along with the room.
+type Payload struct {
+	Seq  uint64 `json:"seq"`
+	Data []byte `json:"data"`
+}
+
+// Invite represents an invite to a room that logs peers in without the
+// room's password. It can be used MaxUses times until it expires. A room's
+// invites expire along with the room.
+type Invite struct {
+	ID        string    `json:"id"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Valid checks whether an invite can still be used.
+func (i Invite) Valid() bool {
+	return i.Uses < i.MaxUses && time.Now().Before(i.ExpiresAt)
 }
 
 // ErrRoomNotFound indicates that the requested room was not found.
 var ErrRoomNotFound = errors.New("room not found")
+
+// ErrInviteNotFound indicates that the requested invite was not found, or
+// that it has expired or been used up.
+var ErrInviteNotFound = errors.New("invite is invalid or has expired")